@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/xerrors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// noteBody returns the text of a message payload.
+// A text/plain part is preferred, and HTML is converted to text if there is no text/plain part.
+// In the latter case, the HTML is also returned.
+func noteBody(p *gmail.MessagePart) (text, htm []byte, err error) {
+	plainPart, htmlPart := findTextParts(p)
+	switch {
+	case plainPart != nil:
+		text, err = decodePart(plainPart)
+		return text, nil, err
+
+	case htmlPart != nil:
+		htm, err = decodePart(htmlPart)
+		if err != nil {
+			return nil, nil, err
+		}
+		return htmlToText(htm), htm, nil
+	}
+	return nil, nil, nil
+}
+
+// findTextParts walks parts depth first, and returns the first text/plain and text/html parts.
+// Attachments are ignored.
+func findTextParts(p *gmail.MessagePart) (plain, htm *gmail.MessagePart) {
+	if p == nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(p.MimeType, "multipart/") {
+		for _, child := range p.Parts {
+			pl, h := findTextParts(child)
+			if plain == nil {
+				plain = pl
+			}
+			if htm == nil {
+				htm = h
+			}
+		}
+		return plain, htm
+	}
+
+	if disp, _, err := mime.ParseMediaType(partHeader(p, "Content-Disposition")); err == nil && disp == "attachment" {
+		return nil, nil
+	}
+
+	switch p.MimeType {
+	case "text/plain", "":
+		return p, nil
+	case "text/html":
+		return nil, p
+	}
+	return nil, nil
+}
+
+// decodePart returns the body of p in UTF-8.
+//
+// In the full format, Gmail has already removed Content-Transfer-Encoding (base64, quoted-printable)
+// of each part, so only the charset is left to be decoded.
+func decodePart(p *gmail.MessagePart) ([]byte, error) {
+	if p.Body == nil {
+		return nil, nil
+	}
+
+	b, err := base64.URLEncoding.DecodeString(p.Body.Data)
+	if err != nil {
+		return nil, xerrors.Errorf("part %v: %v", p.PartId, err)
+	}
+
+	_, params, err := mime.ParseMediaType(partHeader(p, "Content-Type"))
+	if err != nil {
+		return b, nil
+	}
+	return toUTF8(b, params["charset"]), nil
+}
+
+// toUTF8 converts b in charset into UTF-8.
+// b is returned as it is if charset is UTF-8 compatible or unknown.
+func toUTF8(b []byte, charset string) []byte {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "utf-8-sig", "us-ascii":
+		return b
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return b
+	}
+	decoded, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return b
+	}
+	return decoded
+}
+
+func partHeader(p *gmail.MessagePart, name string) string {
+	for _, h := range p.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
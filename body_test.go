@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeNoteBody(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "plain",
+			raw: "Subject: memo\r\n" +
+				"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+				"\r\n" +
+				"hello",
+			want: "hello",
+		},
+		{
+			name: "base64 utf-8-sig",
+			raw: "Subject: memo\r\n" +
+				"Content-Type: text/plain; charset=\"utf-8-sig\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"5pel6KiY",
+			want: "日記",
+		},
+		{
+			name: "shift_jis quoted-printable",
+			raw: "Subject: memo\r\n" +
+				"Content-Type: text/plain; charset=Shift_JIS\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"=93=FA=8BL",
+			want: "日記",
+		},
+		{
+			name: "alternative prefers plain",
+			raw: "Subject: memo\r\n" +
+				"Content-Type: multipart/alternative; boundary=b\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"\r\n" +
+				"<div>html</div>\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"plain\r\n" +
+				"--b--\r\n",
+			want: "plain",
+		},
+		{
+			name: "html only",
+			raw: "Subject: memo\r\n" +
+				"Content-Type: multipart/alternative; boundary=b\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/html; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"<html><head><style>div {}</style></head><body><div>caf=E9</div><div>line2<br>line3</div></body></html>\r\n" +
+				"--b--\r\n",
+			want: "café\nline2\nline3\n",
+		},
+		{
+			name: "nested with an attachment",
+			raw: "Subject: memo\r\n" +
+				"Content-Type: multipart/mixed; boundary=outer\r\n" +
+				"\r\n" +
+				"--outer\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Disposition: attachment; filename=\"a.txt\"\r\n" +
+				"\r\n" +
+				"attached\r\n" +
+				"--outer\r\n" +
+				"Content-Type: multipart/alternative; boundary=inner\r\n" +
+				"\r\n" +
+				"--inner\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"inner plain\r\n" +
+				"--inner--\r\n" +
+				"--outer--\r\n",
+			want: "inner plain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGmail(testLabel)
+			id := f.addRaw(testLabel, tt.raw, time.Now())
+			m, err := f.GetMessage("me", id, "full")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := decodeNote(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(n.Body) != tt.want {
+				t.Errorf("got %q, want %q", n.Body, tt.want)
+			}
+		})
+	}
+}
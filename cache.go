@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// messageCache keeps messages under a label and the mailbox history ID as of the last run.
+//
+// The messages are fetched in full format, and never change since Gmail messages are immutable
+// (except their labels).
+// Changes of the label since HistoryID are fetched by users.history.list.
+type messageCache struct {
+	LabelID   string                    `json:"label_id"`
+	HistoryID uint64                    `json:"history_id"`
+	IDs       []string                  `json:"ids"`
+	Messages  map[string]*gmail.Message `json:"messages"`
+
+	path string
+	mut  sync.Mutex
+}
+
+// loadMessageCache reads a cache file.
+// An empty path results in a cache that is not persisted, and a missing file results in an empty cache.
+func loadMessageCache(path string) (*messageCache, error) {
+	c := &messageCache{path: path}
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, xerrors.Errorf("reading cache file: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, c); err != nil {
+				// just rebuild it
+				fmt.Fprintf(os.Stderr, "WARNING: broken cache file %v: %v\n", path, err)
+				c = &messageCache{path: path}
+			}
+		}
+	}
+
+	if c.Messages == nil {
+		c.Messages = make(map[string]*gmail.Message)
+	}
+	return c, nil
+}
+
+func (c *messageCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	// messages no longer under the label are forgotten
+	ids := make(map[string]struct{}, len(c.IDs))
+	for _, id := range c.IDs {
+		ids[id] = struct{}{}
+	}
+	for id := range c.Messages {
+		if _, found := ids[id]; !found {
+			delete(c.Messages, id)
+		}
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path, b, 0600); err != nil {
+		return xerrors.Errorf("writing cache file: %v", err)
+	}
+	return nil
+}
+
+// labelMessageIDs returns IDs of messages under the label.
+// Only changes since the last run are fetched if possible.
+func (s *gmailStore) labelMessageIDs() ([]string, error) {
+	c := s.cache
+	if c.HistoryID != 0 && c.LabelID == s.label.Id {
+		ids, historyID, err := s.history()
+		if err == nil {
+			c.IDs, c.HistoryID = ids, historyID
+			return ids, nil
+		}
+
+		var gerr *googleapi.Error
+		if !xerrors.As(err, &gerr) || gerr.Code != http.StatusNotFound {
+			return nil, err
+		}
+		// the history ID is too old, scan all
+	}
+
+	// the history ID is taken before listing, not to miss changes while listing
+	profile, err := s.api.GetProfile(s.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.listMessageIDs(s.label.Id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	c.LabelID, c.HistoryID, c.IDs = s.label.Id, profile.HistoryId, ids
+	return ids, nil
+}
+
+// history applies changes since the cached history ID to the cached IDs.
+func (s *gmailStore) history() ([]string, uint64, error) {
+	c := s.cache
+	labelID := s.label.Id
+
+	// latest labels of changed messages, nil if deleted
+	changed := make(map[string][]string)
+	var order []string
+	touch := func(m *gmail.Message, labelIDs []string) {
+		if _, found := changed[m.Id]; !found {
+			order = append(order, m.Id)
+		}
+		changed[m.Id] = labelIDs
+	}
+
+	historyID := c.HistoryID
+	pageToken := ""
+	for {
+		resp, err := s.api.ListHistory(s.userID, c.HistoryID, labelID, pageToken)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, h := range resp.History {
+			for _, a := range h.MessagesAdded {
+				touch(a.Message, a.Message.LabelIds)
+			}
+			for _, a := range h.LabelsAdded {
+				touch(a.Message, a.Message.LabelIds)
+			}
+			for _, r := range h.LabelsRemoved {
+				touch(r.Message, r.Message.LabelIds)
+			}
+			for _, d := range h.MessagesDeleted {
+				touch(d.Message, nil)
+			}
+		}
+		if resp.HistoryId > historyID {
+			historyID = resp.HistoryId
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	isMember := func(labelIDs []string) bool {
+		member := false
+		for _, l := range labelIDs {
+			switch l {
+			case "TRASH", "SPAM":
+				return false
+			case labelID:
+				member = true
+			}
+		}
+		return member
+	}
+
+	ids := make([]string, 0, len(c.IDs)+len(order))
+	// newer first, as messages.list does
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		if isMember(changed[id]) && !containsString(c.IDs, id) {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range c.IDs {
+		if labelIDs, found := changed[id]; found && !isMember(labelIDs) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, historyID, nil
+}
+
+// getMessage returns a message in full format, fetching it if not cached.
+func (s *gmailStore) getMessage(id string) (*gmail.Message, error) {
+	c := s.cache
+
+	c.mut.Lock()
+	m, found := c.Messages[id]
+	c.mut.Unlock()
+	if found {
+		return m, nil
+	}
+
+	m, err := s.api.GetMessage(s.userID, id, "full")
+	if err != nil {
+		return nil, err
+	}
+
+	c.mut.Lock()
+	c.Messages[id] = m
+	c.mut.Unlock()
+	return m, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, ss := range list {
+		if ss == s {
+			return true
+		}
+	}
+	return false
+}
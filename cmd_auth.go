@@ -7,7 +7,7 @@ import (
 type authCmd struct {
 	_ struct{} `help:""`
 
-	Port int `default:"7676"  help:"a temporal port for OAuth authentication. 0 is for copy&paste to CLI."`
+	Port int `default:"7676"  help:"a temporal port for OAuth authentication. 0 is for copy&paste to CLI (without a browser on this machine)."`
 }
 
 func (c authCmd) Run(g globalCmd) error {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	zglob "github.com/mattn/go-zglob"
+	"golang.org/x/xerrors"
+)
+
+type diffCmd struct {
+	InputSrc string `cli:"src,s" default:"./pomera_sync" help:"input directory"`
+
+	Stat    bool `cli:"stat" help:"print the numbers of changed lines of each note, instead of the diff"`
+	Context int  `cli:"unified,U=N" default:"3" help:"lines of context around changes"`
+}
+
+func (c diffCmd) Run(g globalCmd, args []string) error {
+	codec, err := newLocalCodec(g.LocalEncoding, g.EOL)
+	if err != nil {
+		return err
+	}
+
+	store, err := openNoteStore(g)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	state, err := loadSyncState(filepath.Join(c.InputSrc, stateFileName))
+	if err != nil {
+		return err
+	}
+	s := &syncer{
+		store: store,
+		dir:   c.InputSrc,
+		codec: codec,
+		state: state,
+	}
+
+	if len(args) == 0 {
+		args = []string{"*.txt"}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	changed, totalInserted, totalDeleted := 0, 0, 0
+	ambiguous := 0
+
+	// list files
+	for _, arg := range args {
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(c.InputSrc, arg)
+		}
+		ff, err := zglob.Glob(arg)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range ff {
+			if filepath.Base(f) == stateFileName {
+				continue
+			}
+
+			content, err := codec.readFile(f)
+			if err != nil {
+				return fmt.Errorf("read %v: %v", f, err)
+			}
+
+			// resolved as putCmd does
+			path := s.relPath(f)
+			var ns *noteState
+			if path != "" {
+				ns = state.byPath(path)
+			}
+			subject := subjectOfPath(f)
+			if ns != nil {
+				subject = ns.Subject
+			}
+
+			remote, _, err := s.findRemote(ns, subject)
+			var aerr *ambiguousError
+			if xerrors.As(err, &aerr) {
+				fmt.Fprintf(os.Stderr, "ambiguous: %v %v, skipped\n", f, aerr)
+				ambiguous++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			from := "/dev/null"
+			var remoteContent []byte
+			if remote != nil {
+				from = "gmail:" + remote.Subject
+				remoteContent = remote.Body
+			}
+
+			lines := diffLines(splitLines(normalizeForDiff(remoteContent)), splitLines(normalizeForDiff(content)))
+			inserted, deleted := diffStat(lines)
+			if inserted+deleted == 0 {
+				continue
+			}
+			changed++
+			totalInserted += inserted
+			totalDeleted += deleted
+
+			if c.Stat {
+				fmt.Fprintf(tw, " %s\t| %d %s\n", f, inserted+deleted, statBar(inserted, deleted, 40))
+				continue
+			}
+			writeUnifiedDiff(os.Stdout, from, f, lines, c.Context)
+		}
+	}
+
+	if c.Stat {
+		tw.Flush()
+		fmt.Printf(" %d notes changed, %d insertions(+), %d deletions(-)\n", changed, totalInserted, totalDeleted)
+	}
+
+	if ambiguous > 0 {
+		return fmt.Errorf("%d files are skipped, matching different notes of the same subject", ambiguous)
+	}
+	return nil
+}
+
+// normalizeForDiff makes content comparable regardless of line endings and BOM,
+// which are not changes of notes.
+func normalizeForDiff(content []byte) []byte {
+	return convertEOL(bytes.TrimPrefix(content, utf8BOM), eolLF)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffCmd(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "memo", "line1\r\nline2\r\n", time.Now())
+	f.addNote(testLabel, "same", "unchanged\n", time.Now())
+	g := useFakeGmail(t, f)
+
+	os.WriteFile(filepath.Join(dir, "memo.txt"), []byte("line1\nline two\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "same.txt"), []byte("\xef\xbb\xbfunchanged\r\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "new.txt"), []byte("hello\n"), 0644)
+
+	tests := []struct {
+		name string
+		cmd  diffCmd
+		args []string
+
+		want []string
+		not  []string
+	}{
+		{
+			name: "diff",
+			cmd:  diffCmd{InputSrc: dir, Context: 3},
+			args: []string{"memo.txt", "same.txt"},
+			want: []string{"--- gmail:memo\n", " line1\n-line2\n+line two\n"},
+			not:  []string{"same", "\r"},
+		},
+		{
+			name: "new",
+			cmd:  diffCmd{InputSrc: dir, Context: 3},
+			args: []string{"new.txt"},
+			want: []string{"--- /dev/null\n", "+hello\n"},
+		},
+		{
+			name: "stat",
+			cmd:  diffCmd{InputSrc: dir, Context: 3, Stat: true},
+			want: []string{"memo.txt | 2 +-\n", "new.txt  | 1 +\n", " 2 notes changed, 2 insertions(+), 1 deletions(-)\n"},
+			not:  []string{"same"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureStdout(t, func() error {
+				return tt.cmd.Run(g, tt.args)
+			})
+			for _, w := range tt.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("%q not in:\n%s", w, out)
+				}
+			}
+			for _, n := range tt.not {
+				if strings.Contains(out, n) {
+					t.Errorf("%q in:\n%s", n, out)
+				}
+			}
+		})
+	}
+}
@@ -1,26 +1,43 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
-	gmail "google.golang.org/api/gmail/v1"
-	"google.golang.org/api/option"
 )
 
 type getCmd struct {
 	OutputTarget string `cli:"output,o" default:"stdout" help:"output destination {stdout,file}"`
 	OutputFormat string `cli:"format,fo" default:"{subject}.txt" help:"file name format where --output=file ({subect}, {id})"`
 	OutputDest   string `cli:"dest,d" default:"./pomera_sync" help:"output directory where --output=file"`
+	Max          int    `cli:"max=N" default:"0" help:"get only N newer notes (0 means all)"`
+	KeepHTML     bool   `cli:"keep-html" help:"get HTML-only notes (edited in Apple Notes) as HTML, not converted to text"`
+
+	Conflict string `cli:"conflict=POLICY" default:"keep-both" help:"how to resolve notes changed on both sides where --output=file {keep-both,prefer-local,prefer-remote,prompt}"`
+
+	DryRun     bool   `cli:"dry-run,n" help:"print files to be created or overwritten, without changing anything"`
+	PlanFormat string `cli:"plan-format=FORMAT" default:"text" help:"format of --dry-run {text,json}"`
 }
 
 func (c getCmd) Run(g globalCmd, args []string) error {
-	if c.OutputTarget == "file" {
+	if err := checkConflictPolicy(c.Conflict); err != nil {
+		return err
+	}
+
+	if err := checkPlanFormat(c.PlanFormat); err != nil {
+		return err
+	}
+
+	codec, err := newLocalCodec(g.LocalEncoding, g.EOL)
+	if err != nil {
+		return err
+	}
+
+	if c.OutputTarget == "file" && !c.DryRun {
 		if _, err := os.Stat(c.OutputDest); err != nil {
 			err = os.MkdirAll(c.OutputDest, os.ModePerm)
 			if err != nil {
@@ -29,91 +46,163 @@ func (c getCmd) Run(g globalCmd, args []string) error {
 		}
 	}
 
-	config, err := getConfig(g.Credentials, g.ClientID, g.ClientSecret)
+	store, err := openNoteStore(g)
 	if err != nil {
-		return xerrors.Errorf("failed to get config: %v", err)
-	}
-
-	/*client*/
-	_, token, err := getClient(config, g.Token, g.AuthPort)
-	if err != nil {
-		return xerrors.Errorf("failed to connect services: %v", err)
-	}
-
-	ctx := context.Background()
-	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, token)))
-	if err != nil {
-		return xerrors.Errorf("failed to instantiate a gmail service: %v", err)
+		return err
 	}
+	defer store.Close()
 
 	q := strings.Join(args, " ")
 
-	// check for label Notes/pomera_sync
-	var pomeraSync *gmail.Label
-	{
-		labelsService := gmail.NewUsersLabelsService(gmailService)
-		resp, err := labelsService.List(g.UserID).Do()
+	var state *syncState
+	var s *syncer
+	names := make(nameTable)
+	if c.OutputTarget == "file" {
+		state, err = loadSyncState(filepath.Join(c.OutputDest, stateFileName))
 		if err != nil {
 			return err
 		}
-		for _, lbl := range resp.Labels {
-			if lbl.Name == g.Label {
-				pomeraSync = lbl
-			}
+		s = &syncer{
+			dir:   c.OutputDest,
+			codec: codec,
+			state: state,
 		}
-		if pomeraSync == nil {
-			return fmt.Errorf("Label %q not found", g.Label)
+		for _, ns := range state.Notes {
+			names.take(ns.Path, ns.Subject)
 		}
 	}
 
+	var pl plan
+	skipped := 0
+
 	// list messages
 	{
-		msgService := gmail.NewUsersMessagesService(gmailService)
-		resp, err := msgService.List(g.UserID).LabelIds(pomeraSync.Id).Q(q).Do()
+		notes, total, err := store.List(q, c.Max)
 		if err != nil {
 			return err
 		}
-		for _, msg := range resp.Messages {
-			//m, err := msgService.Get(c.LoginID, msg.Id).Format("metadata").Do()
-			m, err := msgService.Get(g.UserID, msg.Id).Format("full").Do()
-			if err != nil {
-				return err
-			}
+		fmt.Fprintf(os.Stderr, "%d of %d notes\n", len(notes), total)
 
-			var content string
-			decoded, err := base64.URLEncoding.DecodeString(m.Payload.Body.Data)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-				break //continue
+		for _, remote := range notes {
+			if c.KeepHTML && remote.HTML != nil {
+				remote.Body = remote.HTML
 			}
-			content = string(decoded)
+			content := string(remote.Body)
 
 			if c.OutputTarget == "file" {
-				fmt.Fprintf(os.Stderr, "getting: %v\n", getHeader(m.Payload.Headers, "Subject"))
+				if !c.DryRun {
+					fmt.Fprintf(os.Stderr, "getting: %v\n", remote.Subject)
+				}
 
 				name := c.OutputFormat
 				if strings.Contains(c.OutputFormat, "{subject}") {
-					name = strings.ReplaceAll(name, "{subject}", getHeader(m.Payload.Headers, "Subject"))
+					name = names.filename(c.OutputFormat, remote.Subject)
 				}
 
 				if c.OutputDest != "" {
 					name = filepath.Join(c.OutputDest, name)
 				}
 
-				file, err := os.Create(name)
-				if err != nil {
-					return fmt.Errorf("create %v: %v", name, err)
+				path := s.relPath(name)
+				var ns *noteState
+				if path != "" {
+					ns = state.byPath(path)
+				}
+
+				local, lerr := codec.readFile(name)
+				if lerr == nil && ns != nil && !ns.localChanged(local) && !ns.remoteChanged(remote) {
+					// up to date, or the local one is kept on a conflict
+					continue
+				}
+
+				if lerr == nil && ns != nil && ns.changedOnBothSides(local, remote) {
+					if c.DryRun {
+						switch c.Conflict {
+						case conflictKeepBoth:
+							pl.add(planItem{Op: planCreate, ID: remote.ID, Path: conflictPath(name, time.Now()), Subject: remote.Subject, Detail: "conflict: the local one is kept"})
+							continue
+						case conflictPreferRemote:
+							// get
+						default:
+							pl.add(planItem{Op: planConflict, ID: remote.ID, Path: name, Subject: remote.Subject, Detail: c.Conflict})
+							continue
+						}
+					} else {
+						switch resolveConflict(c.Conflict, name) {
+						case conflictKeepBoth:
+							aside, err := s.writeAside(path, remote)
+							if err != nil {
+								return err
+							}
+							fmt.Fprintf(os.Stderr, "conflict: the remote one is written as %v\n", filepath.Join(c.OutputDest, aside))
+
+							// the local one is kept, not to report the conflict again
+							state.update(&noteState{
+								ID:         remote.ID,
+								UUID:       remote.UUID,
+								Path:       path,
+								Subject:    remote.Subject,
+								LocalHash:  hashContent(local),
+								RemoteHash: hashContent(remote.Body),
+								Base:       string(local),
+							})
+							if err := state.save(); err != nil {
+								return err
+							}
+							continue
+
+						case conflictPreferRemote:
+							// get
+
+						default:
+							fmt.Fprintf(os.Stderr, "conflict: skipped\n")
+							continue
+						}
+					}
+				}
+
+				if c.DryRun {
+					op := planCreate
+					if _, err := os.Stat(name); err == nil {
+						op = planOverwrite
+					}
+					pl.add(planItem{Op: op, ID: remote.ID, Path: name, Subject: remote.Subject})
+					continue
+				}
+
+				if path != "" {
+					_, err = s.download(path, remote)
+				} else {
+					err = codec.writeFile(name, remote.Body)
 				}
-				_, err = file.WriteString(content)
 				if err != nil {
-					return fmt.Errorf("create %v: %v", name, err)
+					// one note must not stop the others
+					var uerr *unencodableError
+					if !xerrors.As(err, &uerr) {
+						return err
+					}
+					fmt.Fprintf(os.Stderr, "skipped: %v\n", err)
+					skipped++
+					continue
 				}
-				file.Close()
-			} else {
+
+				if path != "" {
+					if err := state.save(); err != nil {
+						return err
+					}
+				}
+			} else if !c.DryRun {
 				fmt.Println(content)
 			}
 		}
 	}
 
+	if c.DryRun {
+		return pl.print(os.Stdout, c.PlanFormat)
+	}
+
+	if skipped > 0 {
+		return fmt.Errorf("%d notes are skipped, having characters not in --local-encoding %v", skipped, codec.name)
+	}
 	return nil
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetCmdStdout(t *testing.T) {
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "diary", "today is a good day", time.Now())
+	f.addNote(testLabel, "todo", "buy milk", time.Now().Add(-time.Hour))
+	g := useFakeGmail(t, f)
+
+	out := captureStdout(t, func() error {
+		return getCmd{OutputTarget: "stdout", Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"milk"})
+	})
+	if strings.TrimSpace(out) != "buy milk" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestGetCmdFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict string
+		dryRun   bool
+
+		local, base, remote string // base is the content of the last get, empty if never
+
+		wantFile  string
+		wantAside string // the other side written as a sibling, empty if none
+	}{
+		{
+			name:     "new",
+			conflict: conflictKeepBoth,
+			remote:   "remote",
+			wantFile: "remote",
+		},
+		{
+			name:     "overwrite without state",
+			conflict: conflictKeepBoth,
+			local:    "local",
+			remote:   "remote",
+			wantFile: "remote",
+		},
+		{
+			name:     "local unchanged",
+			conflict: conflictKeepBoth,
+			local:    "base",
+			base:     "base",
+			remote:   "remote",
+			wantFile: "remote",
+		},
+		{
+			name:      "conflict keep-both",
+			conflict:  conflictKeepBoth,
+			local:     "local",
+			base:      "base",
+			remote:    "remote",
+			wantFile:  "local",
+			wantAside: "remote",
+		},
+		{
+			name:     "conflict prefer-remote",
+			conflict: conflictPreferRemote,
+			local:    "local",
+			base:     "base",
+			remote:   "remote",
+			wantFile: "remote",
+		},
+		{
+			name:     "conflict prefer-local",
+			conflict: conflictPreferLocal,
+			local:    "local",
+			base:     "base",
+			remote:   "remote",
+			wantFile: "local",
+		},
+		{
+			name:     "dry-run",
+			conflict: conflictKeepBoth,
+			dryRun:   true,
+			local:    "local",
+			remote:   "remote",
+			wantFile: "local",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "memo.txt")
+
+			f := newFakeGmail(testLabel)
+			g := useFakeGmail(t, f)
+			cmd := getCmd{
+				OutputTarget: "file",
+				OutputFormat: "{subject}.txt",
+				OutputDest:   dir,
+				Conflict:     tt.conflict,
+				DryRun:       tt.dryRun,
+				PlanFormat:   "text",
+			}
+
+			if tt.base != "" {
+				id := f.addNote(testLabel, "memo", tt.base, time.Now().Add(-time.Hour))
+				captureStdout(t, func() error { return cmd.Run(g, nil) })
+				if err := f.TrashMessage("me", id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.local != "" {
+				if err := os.WriteFile(name, []byte(tt.local), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f.addNote(testLabel, "memo", tt.remote, time.Now())
+
+			captureStdout(t, func() error { return cmd.Run(g, nil) })
+			// nothing more by another get
+			captureStdout(t, func() error { return cmd.Run(g, nil) })
+
+			got, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantFile {
+				t.Errorf("memo.txt: got %q, want %q", got, tt.wantFile)
+			}
+
+			asides, _ := filepath.Glob(filepath.Join(dir, "memo.conflict-*.txt"))
+			switch {
+			case tt.wantAside == "" && len(asides) > 0:
+				t.Errorf("unexpected %v", asides)
+			case tt.wantAside != "" && len(asides) != 1:
+				t.Errorf("got %v, want a conflict file", asides)
+			case tt.wantAside != "":
+				got, _ := os.ReadFile(asides[0])
+				if string(got) != tt.wantAside {
+					t.Errorf("%v: got %q, want %q", asides[0], got, tt.wantAside)
+				}
+			}
+		})
+	}
+}
+
+func TestGetCmdKeepHTML(t *testing.T) {
+	raw := "Subject: memo\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<div>a</div><div>b</div>"
+
+	for _, keep := range []bool{false, true} {
+		f := newFakeGmail(testLabel)
+		f.addRaw(testLabel, raw, time.Now())
+		g := useFakeGmail(t, f)
+
+		out := captureStdout(t, func() error {
+			return getCmd{OutputTarget: "stdout", KeepHTML: keep, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, nil)
+		})
+
+		want := "a\nb\n\n"
+		if keep {
+			want = "<div>a</div><div>b</div>\n"
+		}
+		if out != want {
+			t.Errorf("keep-html=%v: got %q, want %q", keep, out, want)
+		}
+	}
+}
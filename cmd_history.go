@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type historyCmd struct {
+	InputSrc string `cli:"src,s" default:"./pomera_sync" help:"directory of the files"`
+
+	Format string `cli:"format,f" default:"{version} {id} {subject} ({date})" help:"{version}, {id}, {subject}, {date}, {snippet}, {body}"`
+}
+
+func (c historyCmd) Run(g globalCmd, args []string) error {
+	if len(args) != 1 {
+		return errors.New("a note (a file or a subject) is required")
+	}
+
+	store, err := openNoteStore(g)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	s, err := newHistorySyncer(store, c.InputSrc)
+	if err != nil {
+		return err
+	}
+	_, uuid, subject, err := s.noteOf(args[0])
+	if err != nil {
+		return err
+	}
+
+	versions, err := store.Versions(uuid, subject)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d old versions of %v\n", len(versions), subject)
+
+	for i, n := range versions {
+		item := newListItem(c.Format, n)
+		fmt.Println(strings.ReplaceAll(item.Content, "{version}", strconv.Itoa(i+1)))
+	}
+
+	return nil
+}
+
+// used to resolve notes of args
+// history, restore
+func newHistorySyncer(store NoteStore, dir string) (*syncer, error) {
+	state, err := loadSyncState(filepath.Join(dir, stateFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &syncer{
+		store: store,
+		dir:   dir,
+		state: state,
+	}, nil
+}
+
+// noteOf resolves arg, a file under s.dir or a subject, to a note.
+// The current remote note is returned if any, with the UUID (may be empty) and the subject of the note.
+func (s *syncer) noteOf(arg string) (remote *note, uuid, subject string, err error) {
+	name := arg
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(s.dir, name)
+	}
+
+	var ns *noteState
+	if path := s.relPath(name); path != "" {
+		ns = s.state.byPath(path)
+	}
+
+	subject = arg
+	if ns != nil {
+		uuid, subject = ns.UUID, ns.Subject
+	} else if _, err := os.Stat(name); err == nil {
+		subject = subjectOfPath(name)
+	}
+
+	remote, _, err = s.findRemote(ns, subject)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("%v: %v", arg, err)
+	}
+	if remote != nil && remote.UUID != "" {
+		uuid, subject = remote.UUID, remote.Subject
+	}
+	return remote, uuid, subject, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistoryCmd(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepHistory bool
+		arg         string
+
+		want string
+	}{
+		{
+			name:        "file",
+			keepHistory: true,
+			arg:         "memo.txt",
+			want:        "1 v2 2 v1",
+		},
+		{
+			name:        "subject",
+			keepHistory: true,
+			arg:         "memo",
+			want:        "1 v2 2 v1",
+		},
+		{
+			name: "trashed",
+			arg:  "memo.txt",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f := newFakeGmail(testLabel)
+			g := useFakeGmail(t, f)
+			g.KeepHistory = tt.keepHistory
+
+			for _, v := range []string{"v1", "v2", "v3"} {
+				os.WriteFile(filepath.Join(dir, "memo.txt"), []byte(v), 0644)
+				captureStdout(t, func() error {
+					return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"memo.txt"})
+				})
+			}
+			if got := f.notes(testLabel); len(got) != 1 || got["memo"] != "v3" {
+				t.Errorf("notes: got %v", got)
+			}
+
+			out := captureStdout(t, func() error {
+				return historyCmd{InputSrc: dir, Format: "{version} {body}"}.Run(g, []string{tt.arg})
+			})
+			if got := strings.Join(strings.Fields(out), " "); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreCmd(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	g := useFakeGmail(t, f)
+	g.KeepHistory = true
+
+	for _, v := range []string{"v1", "v2"} {
+		os.WriteFile(filepath.Join(dir, "memo.txt"), []byte(v), 0644)
+		captureStdout(t, func() error {
+			return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"memo.txt"})
+		})
+	}
+	uuid := f.noteUUIDs(testLabel)["memo"]
+
+	if err := (restoreCmd{InputSrc: dir, Version: 2}).Run(g, []string{"memo.txt"}); err == nil {
+		t.Error("error expected for a missing version")
+	}
+
+	if err := (restoreCmd{InputSrc: dir, Version: 1}).Run(g, []string{"memo.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.notes(testLabel); len(got) != 1 || got["memo"] != "v1" {
+		t.Errorf("notes: got %v", got)
+	}
+	if got := f.noteUUIDs(testLabel)["memo"]; got != uuid {
+		t.Errorf("UUID changed: %v -> %v", uuid, got)
+	}
+
+	// the replaced one is also kept
+	out := captureStdout(t, func() error {
+		return historyCmd{InputSrc: dir, Format: "{version} {body}"}.Run(g, []string{"memo.txt"})
+	})
+	if got, want := strings.Join(strings.Fields(out), " "), "1 v2 2 v1"; got != want {
+		t.Errorf("history: got %q, want %q", got, want)
+	}
+}
@@ -1,129 +1,43 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
 	"fmt"
 	"os"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/shu-go/gli"
-	"golang.org/x/xerrors"
-	gmail "google.golang.org/api/gmail/v1"
-	"google.golang.org/api/option"
 )
 
 type listCmd struct {
 	Format string      `cli:"format,f" default:"{id} {subject} ({date})" help:"{id}, {subject}, {date}, {snippet}, {body}"`
 	Sort   gli.StrList `cli:"sort" default:"-date,subject,id" help:"sort criteria that is a list of [id, subject, date, snippet] (- means descending order)"`
+	Max    int         `cli:"max=N" default:"0" help:"list only N newer notes (0 means all)"`
 }
 
 func (c listCmd) Run(g globalCmd, args []string) error {
-	config, err := getConfig(g.Credentials, g.ClientID, g.ClientSecret)
+	store, err := openNoteStore(g)
 	if err != nil {
-		return xerrors.Errorf("failed to get config: %v", err)
-	}
-
-	/*client*/
-	_, token, err := getClient(config, g.Token, g.AuthPort)
-	if err != nil {
-		return xerrors.Errorf("failed to connect services: %v", err)
-	}
-
-	ctx := context.Background()
-	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, token)))
-	if err != nil {
-		return xerrors.Errorf("failed to instantiate a gmail service: %v", err)
+		return err
 	}
+	defer store.Close()
 
 	q := strings.Join(args, " ")
 
-	// check for label Notes/pomera_sync
-	var pomeraSync *gmail.Label
-	{
-		labelsService := gmail.NewUsersLabelsService(gmailService)
-		resp, err := labelsService.List(g.UserID).Do()
-		if err != nil {
-			return err
-		}
-		for _, lbl := range resp.Labels {
-			if lbl.Name == g.Label {
-				pomeraSync = lbl
-			}
-		}
-		if pomeraSync == nil {
-			return fmt.Errorf("Label %q not found", g.Label)
-		}
-	}
-
 	list := make([]listItem, 0, 4)
 
 	// list messages
 	{
-		msgService := gmail.NewUsersMessagesService(gmailService)
-		resp, err := msgService.List(g.UserID).LabelIds(pomeraSync.Id).Q(q).Do()
+		notes, total, err := store.List(q, c.Max)
 		if err != nil {
 			return err
 		}
+		fmt.Fprintf(os.Stderr, "%d of %d notes\n", len(notes), total)
 
-		wg := sync.WaitGroup{}
-		mut := sync.Mutex{}
-
-		for _, msg := range resp.Messages {
-			wg.Add(1)
-			go func(msg *gmail.Message) {
-				//m, err := msgService.Get(c.LoginID, msg.Id).Format("metadata").Do()
-				m, err := msgService.Get(g.UserID, msg.Id).Format("full").Do()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-					return
-				}
-
-				content := c.Format
-				content = strings.ReplaceAll(content, "{id}", m.Id)
-				if strings.Contains(c.Format, "{subject}") {
-					content = strings.ReplaceAll(content, "{subject}", getHeader(m.Payload.Headers, "Subject"))
-				}
-				if strings.Contains(c.Format, "{headers}") {
-					content = strings.ReplaceAll(content, "{headers}", fmt.Sprintf("%#v", m.Payload.Headers))
-				}
-				if strings.Contains(c.Format, "{date}") {
-					content = strings.ReplaceAll(content, "{date}", getHeader(m.Payload.Headers, "Date"))
-				}
-				if strings.Contains(c.Format, "{snippet}") {
-					content = strings.ReplaceAll(content, "{snippet}", m.Snippet)
-				}
-				if strings.Contains(c.Format, "{body}") {
-					decoded, err := base64.URLEncoding.DecodeString(m.Payload.Body.Data)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-						return
-					}
-					content = strings.ReplaceAll(content, "{body}", string(decoded))
-				}
-
-				dt, err := time.Parse(time.RFC822Z, getHeader(m.Payload.Headers, "Date"))
-				if err != nil {
-					dt = time.Now()
-				}
-
-				mut.Lock()
-				list = append(list, listItem{
-					Content: content,
-					ID:      m.Id,
-					Subject: getHeader(m.Payload.Headers, "Subject"),
-					Date:    dt,
-					Snippet: m.Snippet,
-				})
-				mut.Unlock()
-
-				wg.Done()
-			}(msg)
+		for _, n := range notes {
+			list = append(list, newListItem(c.Format, n))
 		}
-		wg.Wait()
 	}
 
 	sortListItems(list, c.Sort)
@@ -143,6 +57,34 @@ type listItem struct {
 	Date                 time.Time
 }
 
+func newListItem(format string, n *note) listItem {
+	content := format
+	content = strings.ReplaceAll(content, "{id}", n.ID)
+	if strings.Contains(format, "{subject}") {
+		content = strings.ReplaceAll(content, "{subject}", n.Subject)
+	}
+	if strings.Contains(format, "{headers}") {
+		content = strings.ReplaceAll(content, "{headers}", fmt.Sprintf("%#v", n.Header))
+	}
+	if strings.Contains(format, "{date}") {
+		content = strings.ReplaceAll(content, "{date}", n.Header.Get("Date"))
+	}
+	if strings.Contains(format, "{snippet}") {
+		content = strings.ReplaceAll(content, "{snippet}", n.Snippet)
+	}
+	if strings.Contains(format, "{body}") {
+		content = strings.ReplaceAll(content, "{body}", string(n.Body))
+	}
+
+	return listItem{
+		Content: content,
+		ID:      n.ID,
+		Subject: n.Subject,
+		Date:    n.Date,
+		Snippet: n.Snippet,
+	}
+}
+
 func sortListItems(list []listItem, criteria []string) {
 	sort.Slice(list, func(i, j int) bool {
 		for _, c := range criteria {
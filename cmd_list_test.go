@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListCmd(t *testing.T) {
+	base := time.Date(2021, 4, 1, 9, 0, 0, 0, time.UTC)
+
+	f := newFakeGmail(testLabel, "Other")
+	f.addNote(testLabel, "diary", "today is a good day", base)
+	f.addNote(testLabel, "diary 2023", "last year", base.Add(-time.Hour))
+	f.addNote(testLabel, "todo", "buy milk", base.Add(time.Hour))
+	f.addNote("Other", "secret", "not a note", base)
+	g := useFakeGmail(t, f)
+
+	tests := []struct {
+		name string
+		cmd  listCmd
+		args []string
+		want []string
+	}{
+		{
+			name: "default sort",
+			cmd:  listCmd{Format: "{subject}", Sort: []string{"-date", "subject", "id"}},
+			want: []string{"todo", "diary", "diary 2023"},
+		},
+		{
+			name: "by subject",
+			cmd:  listCmd{Format: "{subject}", Sort: []string{"subject"}},
+			want: []string{"diary", "diary 2023", "todo"},
+		},
+		{
+			name: "body and snippet",
+			cmd:  listCmd{Format: "{subject}:{body}:{snippet}", Sort: []string{"subject"}},
+			want: []string{"diary:today is a good day:today is a good day", "diary 2023:last year:last year", "todo:buy milk:buy milk"},
+		},
+		{
+			name: "query",
+			cmd:  listCmd{Format: "{subject}", Sort: []string{"subject"}},
+			args: []string{"subject:(diary)"},
+			want: []string{"diary", "diary 2023"},
+		},
+		{
+			name: "max",
+			cmd:  listCmd{Format: "{subject}", Sort: []string{"subject"}, Max: 2},
+			want: []string{"diary", "todo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureStdout(t, func() error {
+				return tt.cmd.Run(g, tt.args)
+			})
+
+			got := strings.Split(strings.TrimSpace(out), "\n")
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListCmdPaging(t *testing.T) {
+	base := time.Date(2021, 4, 1, 9, 0, 0, 0, time.UTC)
+
+	f := newFakeGmail(testLabel)
+	f.pageSize = 3
+	for i := 0; i < 10; i++ {
+		f.addNote(testLabel, "note", "body", base.Add(time.Duration(i)*time.Minute))
+	}
+	g := useFakeGmail(t, f)
+
+	out := captureStdout(t, func() error {
+		return listCmd{Format: "{id}", Sort: []string{"id"}}.Run(g, nil)
+	})
+	if got := len(strings.Fields(out)); got != 10 {
+		t.Errorf("got %d notes, want 10", got)
+	}
+}
+
+func TestListCmdSkipsUnreadable(t *testing.T) {
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "good", "body", time.Now())
+	f.broken = map[string]bool{f.addNote(testLabel, "broken", "body", time.Now()): true}
+	g := useFakeGmail(t, f)
+
+	var out string
+	stderr := captureStderr(t, func() error {
+		out = captureStdout(t, func() error {
+			return listCmd{Format: "{subject}"}.Run(g, nil)
+		})
+		return nil
+	})
+	if strings.TrimSpace(out) != "good" {
+		t.Errorf("got %q", out)
+	}
+	if !strings.Contains(stderr, "ERROR") {
+		t.Errorf("stderr: %q", stderr)
+	}
+}
+
+func TestSortListItems(t *testing.T) {
+	d1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	d2 := d1.Add(time.Hour)
+
+	items := []listItem{
+		{ID: "1", Subject: "b", Snippet: "y", Date: d1},
+		{ID: "2", Subject: "a", Snippet: "z", Date: d2},
+		{ID: "3", Subject: "a", Snippet: "x", Date: d1},
+	}
+
+	tests := []struct {
+		criteria []string
+		want     string
+	}{
+		{[]string{"id"}, "123"},
+		{[]string{"-id"}, "321"},
+		{[]string{"subject", "id"}, "231"},
+		{[]string{"subject", "-id"}, "321"},
+		{[]string{"-subject", "id"}, "123"},
+		{[]string{"date", "id"}, "132"},
+		{[]string{"-date", "-id"}, "231"},
+		{[]string{"snippet"}, "312"},
+		{[]string{"-snippet"}, "213"},
+		{[]string{"DATE", "Subject"}, "312"},
+		{[]string{"unknown", "id"}, "123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.criteria, ","), func(t *testing.T) {
+			list := append([]listItem(nil), items...)
+			sortListItems(list, tt.criteria)
+
+			got := ""
+			for _, item := range list {
+				got += item.ID
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
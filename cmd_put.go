@@ -1,60 +1,56 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
 
 	zglob "github.com/mattn/go-zglob"
 	"golang.org/x/xerrors"
-	gmail "google.golang.org/api/gmail/v1"
-	"google.golang.org/api/option"
 )
 
 type putCmd struct {
 	InputSrc string `cli:"src,s" default:"./pomera_sync" help:"input directory"`
+
+	Conflict string `cli:"conflict=POLICY" default:"keep-both" help:"how to resolve notes changed on both sides {keep-both,prefer-local,prefer-remote,prompt}"`
+
+	DryRun     bool   `cli:"dry-run,n" help:"print messages to be trashed and inserted, without changing anything"`
+	PlanFormat string `cli:"plan-format=FORMAT" default:"text" help:"format of --dry-run {text,json}"`
 }
 
 func (c putCmd) Run(g globalCmd, args []string) error {
-	config, err := getConfig(g.Credentials, g.ClientID, g.ClientSecret)
+	if err := checkConflictPolicy(c.Conflict); err != nil {
+		return err
+	}
+	if err := checkPlanFormat(c.PlanFormat); err != nil {
+		return err
+	}
+	codec, err := newLocalCodec(g.LocalEncoding, g.EOL)
 	if err != nil {
-		return xerrors.Errorf("failed to get config: %v", err)
+		return err
 	}
 
-	/*client*/
-	_, token, err := getClient(config, g.Token, g.AuthPort)
+	store, err := openNoteStore(g)
 	if err != nil {
-		return xerrors.Errorf("failed to connect services: %v", err)
+		return err
 	}
+	defer store.Close()
 
-	ctx := context.Background()
-	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, token)))
+	state, err := loadSyncState(filepath.Join(c.InputSrc, stateFileName))
 	if err != nil {
-		return xerrors.Errorf("failed to instantiate a gmail service: %v", err)
+		return err
 	}
-
-	// check for label Notes/pomera_sync
-	var pomeraSync *gmail.Label
-	{
-		labelsService := gmail.NewUsersLabelsService(gmailService)
-		resp, err := labelsService.List(g.UserID).Do()
-		if err != nil {
-			return err
-		}
-		for _, lbl := range resp.Labels {
-			if lbl.Name == g.Label {
-				pomeraSync = lbl
-			}
-		}
-		if pomeraSync == nil {
-			return fmt.Errorf("Label %q not found", g.Label)
-		}
+	s := &syncer{
+		store: store,
+		dir:   c.InputSrc,
+		codec: codec,
+		state: state,
 	}
 
+	var pl plan
+	ambiguous := 0
+
 	// list files
 	for _, arg := range args {
 		if !filepath.IsAbs(arg) {
@@ -66,62 +62,125 @@ func (c putCmd) Run(g globalCmd, args []string) error {
 		}
 
 		for _, f := range ff {
-			fmt.Fprintf(os.Stderr, "putting: %v\n", f)
+			if filepath.Base(f) == stateFileName {
+				continue
+			}
 
-			file, err := os.Open(f)
-			if err != nil {
-				return fmt.Errorf("open %v: %v", f, err)
+			if !c.DryRun {
+				fmt.Fprintf(os.Stderr, "putting: %v\n", f)
 			}
-			content, err := ioutil.ReadAll(file)
+
+			content, err := codec.readFile(f)
 			if err != nil {
 				return fmt.Errorf("read %v: %v", f, err)
 			}
-			file.Close()
 
-			filename := filepath.Base(f)
-			extlen := len(filepath.Ext(filename))
+			path := s.relPath(f)
+			var ns *noteState
+			if path != "" {
+				ns = state.byPath(path)
+			}
+
+			// the state knows the subject of a file whose name is truncated or made unique
+			subject := subjectOfPath(f)
+			if ns != nil {
+				subject = ns.Subject
+			}
 
 			// find messages
-			{
-				msgService := gmail.NewUsersMessagesService(gmailService)
-				resp, err := msgService.List(g.UserID).LabelIds(pomeraSync.Id).Q("subject:(" + filename[:len(filename)-extlen] + ")").Do()
-				if err != nil {
-					return err
+			remote, duplicates, err := s.findRemote(ns, subject)
+			var aerr *ambiguousError
+			if xerrors.As(err, &aerr) {
+				if c.DryRun {
+					pl.add(planItem{Op: planConflict, Path: f, Subject: subject, Detail: "ambiguous: " + aerr.ids()})
+				} else {
+					fmt.Fprintf(os.Stderr, "ambiguous: %v %v, skipped\n", f, aerr)
 				}
-				if len(resp.Messages) > 0 {
-					_, err := msgService.Trash(g.UserID, resp.Messages[0].Id).Do()
-					if err != nil {
-						return err
+				ambiguous++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if remote != nil && ns != nil && ns.UUID != "" && remote.UUID == ns.UUID {
+				// keep the new subject of the note renamed remotely
+				subject = remote.Subject
+			}
+
+			replaceID := ""
+			if remote != nil {
+				replaceID = remote.ID
+			}
+
+			if ns != nil && remote != nil && ns.changedOnBothSides(content, remote) {
+				if c.DryRun {
+					switch c.Conflict {
+					case conflictKeepBoth:
+						pl.add(planItem{Op: planCreate, Path: conflictPath(f, time.Now()), Subject: remote.Subject, Detail: "conflict: the remote one is kept"})
+					case conflictPreferLocal:
+						// put
+					default:
+						pl.add(planItem{Op: planConflict, ID: remote.ID, Path: f, Subject: subject, Detail: c.Conflict})
+						continue
+					}
+				} else {
+					switch resolveConflict(c.Conflict, f) {
+					case conflictKeepBoth:
+						aside, err := s.writeAside(path, remote)
+						if err != nil {
+							return err
+						}
+						fmt.Fprintf(os.Stderr, "conflict: the remote one is kept as %v\n", filepath.Join(c.InputSrc, aside))
+
+					case conflictPreferLocal:
+						// put
+
+					default:
+						fmt.Fprintf(os.Stderr, "conflict: skipped\n")
+						continue
 					}
 				}
 			}
 
-			subject := base64.StdEncoding.EncodeToString([]byte(filename[:len(filename)-extlen]))
+			if c.DryRun {
+				if replaceID != "" {
+					pl.add(planItem{Op: planReplaced(g), ID: replaceID, Subject: remote.Subject})
+				}
+				for _, d := range duplicates {
+					pl.add(planItem{Op: planTrash, ID: d.ID, Subject: d.Subject, Detail: "duplicate"})
+				}
+				pl.add(planItem{Op: planInsert, Path: f, Subject: subject})
+				continue
+			}
+
+			_, err = s.upload(path, subject, content, replaceID)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-				break //continue
+				return err
 			}
 
-			msg := gmail.Message{
-				LabelIds: []string{pomeraSync.Id},
-				Raw: base64.URLEncoding.EncodeToString([]byte("Content-Type: text/plain; charset=\"utf-8-sig\"\r\n" +
-					"MIME-Version: 1.0\r\n" +
-					"Content-Transfer-Encoding: base64\r\n" +
-					"X-Uniform-Type-Identifier: com.apple.mail-note\r\n" +
-					"From: " + g.UserID + "\r\n" +
-					"Subject: =?UTF-8?B?" + subject + "?=\r\n" +
-					"Date: " + time.Now().Format(time.RFC822Z) + "\r\n" +
-					"\r\n" +
-					base64.StdEncoding.EncodeToString(content))),
+			for _, d := range duplicates {
+				fmt.Fprintf(os.Stderr, "trashing a duplicate: %v\n", d.ID)
+				if err := store.Trash(d.ID); err != nil {
+					return err
+				}
 			}
 
-			msgService := gmail.NewUsersMessagesService(gmailService)
-			_, err = msgService.Insert(g.UserID, &msg).Do()
-			if err != nil {
-				return err
+			if path != "" {
+				if err := state.save(); err != nil {
+					return err
+				}
 			}
 		}
 	}
 
+	if c.DryRun {
+		if err := pl.print(os.Stdout, c.PlanFormat); err != nil {
+			return err
+		}
+	}
+
+	if ambiguous > 0 {
+		return fmt.Errorf("%d files are skipped, matching different notes of the same subject", ambiguous)
+	}
 	return nil
 }
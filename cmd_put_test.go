@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPutCmd(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote map[string]string // subject -> body, before put
+		files  map[string]string
+		args   []string
+		dryRun bool
+
+		want map[string]string
+	}{
+		{
+			name:  "new",
+			files: map[string]string{"memo.txt": "hello"},
+			args:  []string{"*.txt"},
+			want:  map[string]string{"memo": "hello"},
+		},
+		{
+			name:   "replace",
+			remote: map[string]string{"memo": "old", "other": "keep"},
+			files:  map[string]string{"memo.txt": "new"},
+			args:   []string{"memo.txt"},
+			want:   map[string]string{"memo": "new", "other": "keep"},
+		},
+		{
+			name:  "japanese subject",
+			files: map[string]string{"日記.txt": "晴れ"},
+			args:  []string{"*.txt"},
+			want:  map[string]string{"日記": "晴れ"},
+		},
+		{
+			name:  "state file is skipped",
+			files: map[string]string{"memo.txt": "hello"},
+			args:  []string{"*"},
+			want:  map[string]string{"memo": "hello"},
+		},
+		{
+			name:   "dry-run",
+			remote: map[string]string{"memo": "old"},
+			files:  map[string]string{"memo.txt": "new"},
+			args:   []string{"memo.txt"},
+			dryRun: true,
+			want:   map[string]string{"memo": "old"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f := newFakeGmail(testLabel)
+			g := useFakeGmail(t, f)
+
+			for subject, body := range tt.remote {
+				f.addNote(testLabel, subject, body, time.Now().Add(-time.Hour))
+			}
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(dir, stateFileName), []byte("{}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			out := captureStdout(t, func() error {
+				return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, DryRun: tt.dryRun, PlanFormat: "text"}.Run(g, tt.args)
+			})
+
+			if got := f.notes(testLabel); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.dryRun && !strings.Contains(out, planTrash) {
+				t.Errorf("no plan: %q", out)
+			}
+		})
+	}
+}
+
+func TestPutCmdConflict(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	g := useFakeGmail(t, f)
+
+	name := filepath.Join(dir, "memo.txt")
+	os.WriteFile(name, []byte("base"), 0644)
+	cmd := putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}
+	captureStdout(t, func() error { return cmd.Run(g, []string{"memo.txt"}) })
+
+	// edited on both sides, the remote one is replaced by another message
+	for id := range f.messages {
+		f.TrashMessage("me", id)
+	}
+	f.addNote(testLabel, "memo", "remote", time.Now())
+	os.WriteFile(name, []byte("local"), 0644)
+
+	captureStdout(t, func() error { return cmd.Run(g, []string{"memo.txt"}) })
+
+	if got := f.notes(testLabel); got["memo"] != "local" {
+		t.Errorf("got %v", got)
+	}
+	asides, _ := filepath.Glob(filepath.Join(dir, "memo.conflict-*.txt"))
+	if len(asides) != 1 {
+		t.Fatalf("got %v, want a conflict file", asides)
+	}
+	if got, _ := os.ReadFile(asides[0]); string(got) != "remote" {
+		t.Errorf("%v: got %q", asides[0], got)
+	}
+}
+
+func TestPutCmdExactSubject(t *testing.T) {
+	tests := []struct {
+		name   string
+		raws   []string // notes before put
+		dryRun bool
+
+		wantErr    bool
+		wantMemo   []string // bodies of notes "memo" after put
+		wantOthers map[string]string
+	}{
+		{
+			name:       "similar subjects",
+			raws:       []string{"Subject: memo 2023\r\n\r\nold", "Subject: my memo\r\n\r\nold"},
+			wantMemo:   []string{"new"},
+			wantOthers: map[string]string{"memo 2023": "old", "my memo": "old"},
+		},
+		{
+			name:       "duplicates",
+			raws:       []string{"Subject: memo\r\n\r\nold1", "Subject: memo\r\n\r\nold2", "Subject: =?UTF-8?B?bWVtbw==?=\r\n\r\nold3"},
+			wantMemo:   []string{"new"},
+			wantOthers: map[string]string{},
+		},
+		{
+			name: "duplicates of a UUID",
+			raws: []string{
+				"Subject: memo\r\n" + uuidHeader + ": U1\r\n\r\nold1",
+				"Subject: memo\r\n" + uuidHeader + ": U1\r\n\r\nold2",
+				"Subject: memo\r\n\r\nold3",
+			},
+			wantMemo:   []string{"new"},
+			wantOthers: map[string]string{},
+		},
+		{
+			name: "ambiguous",
+			raws: []string{
+				"Subject: memo\r\n" + uuidHeader + ": U1\r\n\r\nold1",
+				"Subject: memo\r\n" + uuidHeader + ": U2\r\n\r\nold2",
+			},
+			wantErr:    true,
+			wantMemo:   []string{"old1", "old2"},
+			wantOthers: map[string]string{},
+		},
+		{
+			name:       "dry-run",
+			raws:       []string{"Subject: memo\r\n\r\nold1", "Subject: memo\r\n\r\nold2"},
+			dryRun:     true,
+			wantMemo:   []string{"old1", "old2"},
+			wantOthers: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "memo.txt"), []byte("new"), 0644)
+
+			f := newFakeGmail(testLabel)
+			for i, raw := range tt.raws {
+				f.addRaw(testLabel, raw, time.Now().Add(time.Duration(i)*time.Minute))
+			}
+			g := useFakeGmail(t, f)
+
+			cmd := putCmd{InputSrc: dir, Conflict: conflictKeepBoth, DryRun: tt.dryRun, PlanFormat: "text"}
+			err := cmd.Run(g, []string{"memo.txt"})
+			if tt.wantErr != (err != nil) {
+				t.Errorf("err: %v", err)
+			}
+
+			var memo []string
+			others := make(map[string]string)
+			for _, m := range f.messages {
+				if hasLabel(m, "TRASH") {
+					continue
+				}
+				header, body := parseFakeMessage(m.raw)
+				subject := decodeFakeHeader(header.Get("Subject"))
+				body = decodeFakeCTE(header.Get("Content-Transfer-Encoding"), body)
+				if subject == "memo" {
+					memo = append(memo, string(body))
+				} else {
+					others[subject] = string(body)
+				}
+			}
+			sort.Strings(memo)
+			if !reflect.DeepEqual(memo, tt.wantMemo) {
+				t.Errorf("memo: got %q, want %q", memo, tt.wantMemo)
+			}
+			if !reflect.DeepEqual(others, tt.wantOthers) {
+				t.Errorf("others: got %v, want %v", others, tt.wantOthers)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+type restoreCmd struct {
+	InputSrc string `cli:"src,s" default:"./pomera_sync" help:"directory of the files"`
+
+	Version int `cli:"version,v=N" default:"1" help:"version shown by 'history' subcommand (1 is the latest old one)"`
+}
+
+func (c restoreCmd) Run(g globalCmd, args []string) error {
+	if len(args) != 1 {
+		return errors.New("a note (a file or a subject) is required")
+	}
+
+	store, err := openNoteStore(g)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	s, err := newHistorySyncer(store, c.InputSrc)
+	if err != nil {
+		return err
+	}
+	current, uuid, subject, err := s.noteOf(args[0])
+	if err != nil {
+		return err
+	}
+
+	versions, err := store.Versions(uuid, subject)
+	if err != nil {
+		return err
+	}
+	if c.Version < 1 || len(versions) < c.Version {
+		return fmt.Errorf("%v has %d old versions, no version %d", subject, len(versions), c.Version)
+	}
+	old := versions[c.Version-1]
+
+	// the old one is copied as the latest, and the current one becomes an old version
+	fmt.Fprintf(os.Stderr, "restoring: %v (%v)\n", old.Subject, old.ID)
+	if old.UUID != "" {
+		uuid = old.UUID
+	}
+	if _, err := store.Create(uuid, old.Subject, old.Body); err != nil {
+		return err
+	}
+	if current != nil {
+		if err := store.Archive(current.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
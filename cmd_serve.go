@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type serveCmd struct {
+	Dir string `cli:"dir,d" default:"./pomera_sync" help:"local directory to be synchronized"`
+
+	Interval time.Duration `cli:"interval=DURATION" default:"15m" help:"interval of scheduled syncs"`
+	Listen   string        `cli:"listen=ADDR" default:"127.0.0.1:7879" help:"address of the control API, or unix:PATH for a Unix socket"`
+
+	Conflict    string `cli:"conflict=POLICY" default:"merge" help:"how to resolve notes changed on both sides, after merging non-overlapping changes {merge,keep-both,prefer-local,prefer-remote}"`
+	LocalDelete string `cli:"local-delete=HOW" default:"trash" help:"how to delete files whose notes are deleted {trash,remove}"`
+	MaxDelete   int    `cli:"max-delete=PERCENT" default:"50" help:"refuse to sync if more than PERCENT% of notes would be deleted"`
+}
+
+func (c serveCmd) Run(g globalCmd) error {
+	if c.Conflict == conflictPrompt {
+		return fmt.Errorf("--conflict %v is not available in serve", conflictPrompt)
+	}
+	if c.Interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	l, err := listenControl(c.Listen)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sc := syncCmd{
+		Dir:         c.Dir,
+		Conflict:    c.Conflict,
+		LocalDelete: c.LocalDelete,
+		MaxDelete:   c.MaxDelete,
+		PlanFormat:  "text",
+	}
+	r := newSyncRunner(c.Dir, c.Interval, func() (*syncReport, error) {
+		return sc.sync(g)
+	})
+
+	return serveRunner(ctx, r, l)
+}
+
+// serveRunner runs r, serving its control API on l, until ctx is done.
+func serveRunner(ctx context.Context, r *syncRunner, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	server := &http.Server{
+		Handler:           localOnly(l.Addr(), r.handler()),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+	fmt.Fprintf(os.Stderr, "control API: %v\n", l.Addr())
+
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err := <-served:
+		cancel()
+		<-done
+		return fmt.Errorf("control API: %v", err)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// connections opened by clients but not used are waited for until the timeout
+		server.Close()
+	}
+
+	<-done
+	fmt.Fprintf(os.Stderr, "stopped\n")
+	return nil
+}
+
+// listenControl listens on addr, which is host:port or unix:PATH.
+func listenControl(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// a socket left by a previous run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("listen %v: %v", addr, err)
+		}
+		// only the owner can control
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("chmod %v: %v", path, err)
+		}
+		return l, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %v: %v", addr, err)
+	}
+	return l, nil
+}
+
+// localOnly rejects requests to h made by web pages.
+//
+// Over TCP, Host must be an IP address or localhost with the port of addr,
+// against DNS rebinding by a page of another name.
+// Origin, sent by browsers on cross-origin requests, must be of the host itself.
+func localOnly(addr net.Addr, h http.Handler) http.Handler {
+	port := ""
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		port = strconv.Itoa(tcp.Port)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if port != "" {
+			host, p, err := net.SplitHostPort(req.Host)
+			if err != nil || p != port || (host != "localhost" && net.ParseIP(host) == nil) {
+				http.Error(w, "invalid host", http.StatusForbidden)
+				return
+			}
+		}
+		if origin := req.Header.Get("Origin"); origin != "" && origin != "http://"+req.Host {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
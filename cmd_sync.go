@@ -0,0 +1,669 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+type syncCmd struct {
+	Dir   string `cli:"dir,d" default:"./pomera_sync" help:"local directory to be synchronized"`
+	State string `cli:"state=FILE_NAME" help:"sync state file (default: DIR/.pmsync.json)"`
+
+	Conflict string `cli:"conflict=POLICY" default:"merge" help:"how to resolve notes changed on both sides, after merging non-overlapping changes {merge,keep-both,prefer-local,prefer-remote,prompt}"`
+
+	LocalDelete string `cli:"local-delete=HOW" default:"trash" help:"how to delete files whose notes are deleted {trash,remove} (trash moves them into DIR/.pmsync-trash)"`
+	MaxDelete   int    `cli:"max-delete=PERCENT" default:"50" help:"refuse to sync if more than PERCENT% of notes would be deleted"`
+
+	DryRun     bool   `cli:"dry-run,n" help:"print the plan, without changing anything"`
+	PlanFormat string `cli:"plan-format=FORMAT" default:"text" help:"format of --dry-run {text,json}"`
+}
+
+// how to delete local files
+const (
+	localDeleteTrash  = "trash"
+	localDeleteRemove = "remove"
+)
+
+// localTrashDir is a directory in the synchronized directory, where deleted files are moved into.
+const localTrashDir = ".pmsync-trash"
+
+// sync operations
+const (
+	syncUpload        = "upload"
+	syncDownload      = "download"
+	syncConflict      = "conflict"
+	syncDownloadAside = "download-aside" // the path is used by another note
+	syncLink          = "link"           // same content on both sides, only the state is recorded
+	syncDeleteRemote  = "delete-remote"  // deleted locally
+	syncDeleteLocal   = "delete-local"   // deleted remotely
+	syncForget        = "forget"         // deleted on both sides, only the state is removed
+)
+
+type syncAction struct {
+	Op      string
+	Path    string
+	Subject string
+
+	state  *noteState // nil if new
+	local  []byte
+	remote *note
+}
+
+// syncReport is what a sync has done.
+type syncReport struct {
+	Start     time.Time            `json:"start"`
+	End       time.Time            `json:"end"`
+	Actions   int                  `json:"actions"`
+	Skipped   []string             `json:"skipped,omitempty"` // paths not written in the local encoding
+	Conflicts []syncConflictReport `json:"conflicts"`
+}
+
+// conflict reports
+const (
+	conflictReportMarkers = "markers" // merged with conflict markers in the file
+	conflictReportAside   = "aside"   // the remote one is written aside
+	conflictReportSkipped = "skipped"
+)
+
+// syncConflictReport is a conflict left to the user.
+type syncConflictReport struct {
+	Path    string    `json:"path"`
+	Subject string    `json:"subject"`
+	Kind    string    `json:"kind"`
+	Aside   string    `json:"aside,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// pending reports whether the conflict is not resolved yet by the user.
+// Skipped ones are reported again by the next sync.
+func (r syncConflictReport) pending(dir string) bool {
+	switch r.Kind {
+	case conflictReportMarkers:
+		b, err := os.ReadFile(filepath.Join(dir, r.Path))
+		return err == nil && hasConflictMarkers(b)
+	case conflictReportAside:
+		_, err := os.Stat(filepath.Join(dir, r.Aside))
+		return err == nil
+	}
+	return false
+}
+
+func (c syncCmd) Run(g globalCmd) error {
+	_, err := c.sync(g)
+	return err
+}
+
+// sync synchronizes c.Dir, and reports what is done.
+// Nothing is reported in --dry-run.
+// Notes not written in the local encoding are skipped, and reported with an error after the others.
+func (c syncCmd) sync(g globalCmd) (*syncReport, error) {
+	if c.Conflict != conflictMerge {
+		if err := checkConflictPolicy(c.Conflict); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPlanFormat(c.PlanFormat); err != nil {
+		return nil, err
+	}
+	if c.LocalDelete != localDeleteTrash && c.LocalDelete != localDeleteRemove {
+		return nil, fmt.Errorf("unknown --local-delete %q", c.LocalDelete)
+	}
+	codec, err := newLocalCodec(g.LocalEncoding, g.EOL)
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := c.State
+	if statePath == "" {
+		statePath = filepath.Join(c.Dir, stateFileName)
+	}
+	state, err := loadSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openNoteStore(g)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	notes, _, err := store.List("", 0)
+	if err != nil {
+		return nil, err
+	}
+	remotes := make(map[string]*note, len(notes))
+	for _, n := range notes {
+		remotes[n.ID] = n
+	}
+
+	locals, err := readLocalNotes(c.Dir, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &syncer{
+		store: store,
+		dir:   c.Dir,
+		codec: codec,
+		state: state,
+	}
+
+	actions := planSync(state, locals, remotes)
+
+	// notes whose messages are not read would be taken as deleted remotely
+	if unreadable := store.Unreadable(); len(unreadable) > 0 {
+		kept := actions[:0]
+		for _, a := range actions {
+			if a.state != nil && a.remote == nil {
+				fmt.Fprintf(os.Stderr, "skipped: %v (%d messages are not read)\n", a.Path, len(unreadable))
+				continue
+			}
+			kept = append(kept, a)
+		}
+		actions = kept
+	}
+
+	// a safety net against mass deletion, by a wrong directory or something
+	deletions := 0
+	for _, a := range actions {
+		if a.Op == syncDeleteRemote || a.Op == syncDeleteLocal {
+			deletions++
+		}
+	}
+	if deletions > 0 && deletions*100 > len(state.Notes)*c.MaxDelete {
+		err := fmt.Errorf("%d of %d notes would be deleted, exceeding --max-delete %d%%", deletions, len(state.Notes), c.MaxDelete)
+		if !c.DryRun {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+
+	if c.DryRun {
+		var pl plan
+		for _, a := range actions {
+			c.plan(&pl, a, planReplaced(g))
+		}
+		return nil, pl.print(os.Stdout, c.PlanFormat)
+	}
+
+	rep := &syncReport{Start: time.Now()}
+	for _, a := range actions {
+		if err := c.do(s, a, rep); err != nil {
+			// one note must not stop the others
+			var uerr *unencodableError
+			if !xerrors.As(err, &uerr) {
+				return nil, err
+			}
+			fmt.Fprintf(os.Stderr, "skipped: %v\n", err)
+			rep.Skipped = append(rep.Skipped, a.Path)
+			continue
+		}
+		rep.Actions++
+
+		// save as we go, not to lose the results of succeeded actions
+		if err := state.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	rep.End = time.Now()
+	if len(rep.Skipped) > 0 {
+		return rep, fmt.Errorf("%d notes are skipped, having characters not in --local-encoding %v", len(rep.Skipped), codec.name)
+	}
+	return rep, nil
+}
+
+// do takes an action, and adds conflicts left to the user to rep.
+func (c syncCmd) do(s *syncer, a syncAction, rep *syncReport) error {
+	replaceID := ""
+	if a.remote != nil {
+		replaceID = a.remote.ID
+	}
+
+	switch a.Op {
+	case syncUpload:
+		if a.state != nil && hasConflictMarkers(a.local) {
+			fmt.Fprintf(os.Stderr, "conflict: %v, not uploaded until the conflict markers are resolved\n", a.Path)
+			rep.Conflicts = append(rep.Conflicts, syncConflictReport{Path: a.Path, Subject: a.Subject, Kind: conflictReportMarkers, Time: time.Now()})
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "uploading: %v\n", a.Path)
+		_, err := s.upload(a.Path, a.Subject, a.local, replaceID)
+		return err
+
+	case syncDownload:
+		fmt.Fprintf(os.Stderr, "downloading: %v\n", a.Path)
+		_, err := s.download(a.Path, a.remote)
+		return err
+
+	case syncDownloadAside:
+		aside, err := s.writeAside(a.Path, a.remote)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "downloading: %v (%v is used by another note)\n", aside, a.Path)
+		s.state.update(&noteState{
+			ID:         a.remote.ID,
+			UUID:       a.remote.UUID,
+			Path:       aside,
+			Subject:    a.remote.Subject,
+			LocalHash:  hashContent(a.remote.Body),
+			RemoteHash: hashContent(a.remote.Body),
+			Base:       string(a.remote.Body),
+		})
+		return nil
+
+	case syncDeleteRemote:
+		fmt.Fprintf(os.Stderr, "trashing: %v\n", a.Path)
+		if err := s.store.Trash(a.remote.ID); err != nil {
+			return err
+		}
+		s.state.remove(a.state)
+		return nil
+
+	case syncDeleteLocal:
+		name := filepath.Join(s.dir, a.Path)
+		if c.LocalDelete == localDeleteRemove {
+			fmt.Fprintf(os.Stderr, "removing: %v\n", a.Path)
+			if err := os.Remove(name); err != nil {
+				return fmt.Errorf("remove %v: %v", name, err)
+			}
+		} else {
+			dest := localTrashPath(s.dir, a.Path)
+			fmt.Fprintf(os.Stderr, "removing: %v (moved to %v)\n", a.Path, dest)
+			if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+				return fmt.Errorf("mkdir %v: %v", filepath.Dir(dest), err)
+			}
+			if err := os.Rename(name, dest); err != nil {
+				return fmt.Errorf("move %v: %v", name, err)
+			}
+		}
+		s.state.remove(a.state)
+		return nil
+
+	case syncForget:
+		s.state.remove(a.state)
+		return nil
+
+	case syncLink:
+		s.state.update(&noteState{
+			ID:         a.remote.ID,
+			UUID:       a.remote.UUID,
+			Path:       a.Path,
+			Subject:    a.Subject,
+			LocalHash:  hashContent(a.local),
+			RemoteHash: hashContent(a.remote.Body),
+			Base:       string(a.local),
+		})
+		return nil
+
+	case syncConflict:
+		policy := c.Conflict
+		if a.state != nil {
+			merged, conflicts := merge3([]byte(a.state.Base), a.local, a.remote.Body)
+			if conflicts == 0 || policy == conflictMerge {
+				// markers may be left unresolved from the last merge
+				if conflicts == 0 && !hasConflictMarkers(merged) {
+					fmt.Fprintf(os.Stderr, "merging: %v\n", a.Path)
+					if err := s.codec.writeFile(filepath.Join(s.dir, a.Path), merged); err != nil {
+						return err
+					}
+					_, err := s.upload(a.Path, a.Subject, merged, replaceID)
+					return err
+				}
+
+				fmt.Fprintf(os.Stderr, "merging: %v (%d conflicts, not uploaded until resolved)\n", a.Path, conflicts)
+				rep.Conflicts = append(rep.Conflicts, syncConflictReport{Path: a.Path, Subject: a.Subject, Kind: conflictReportMarkers, Time: time.Now()})
+
+				// the remote one is kept as is, and synced as the base,
+				// so that the file resolved by the user is a local change to it
+				if err := s.codec.writeFile(filepath.Join(s.dir, a.Path), merged); err != nil {
+					return err
+				}
+				s.state.update(&noteState{
+					ID:         a.remote.ID,
+					UUID:       a.remote.UUID,
+					Path:       a.Path,
+					Subject:    a.remote.Subject,
+					LocalHash:  hashContent(a.remote.Body),
+					RemoteHash: hashContent(a.remote.Body),
+					Base:       string(a.remote.Body),
+				})
+				return nil
+			}
+		}
+		if policy == conflictMerge {
+			// no common ancestor
+			policy = conflictKeepBoth
+		}
+
+		switch resolveConflict(policy, a.Path) {
+		case conflictKeepBoth:
+			aside, err := s.writeAside(a.Path, a.remote)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "conflict: %v, the remote one is kept as %v\n", a.Path, aside)
+			rep.Conflicts = append(rep.Conflicts, syncConflictReport{Path: a.Path, Subject: a.Subject, Kind: conflictReportAside, Aside: aside, Time: time.Now()})
+
+			_, err = s.upload(aside, subjectOfPath(aside), a.remote.Body, "")
+			if err != nil {
+				return err
+			}
+			_, err = s.upload(a.Path, a.Subject, a.local, replaceID)
+			return err
+
+		case conflictPreferLocal:
+			fmt.Fprintf(os.Stderr, "conflict: %v, uploading the local one\n", a.Path)
+			_, err := s.upload(a.Path, a.Subject, a.local, replaceID)
+			return err
+
+		case conflictPreferRemote:
+			fmt.Fprintf(os.Stderr, "conflict: %v, downloading the remote one\n", a.Path)
+			_, err := s.download(a.Path, a.remote)
+			return err
+
+		default:
+			fmt.Fprintf(os.Stderr, "conflict: %v, skipped\n", a.Path)
+			rep.Conflicts = append(rep.Conflicts, syncConflictReport{Path: a.Path, Subject: a.Subject, Kind: conflictReportSkipped, Time: time.Now()})
+		}
+	}
+
+	return nil
+}
+
+// plan adds what c.do(a) would do to pl.
+// replaceOp is the operation on a replaced message.
+func (c syncCmd) plan(pl *plan, a syncAction, replaceOp string) {
+	name := filepath.Join(c.Dir, a.Path)
+
+	upload := func(path, subject string) {
+		if a.remote != nil {
+			pl.add(planItem{Op: replaceOp, ID: a.remote.ID, Subject: a.remote.Subject})
+		}
+		pl.add(planItem{Op: planInsert, Path: path, Subject: subject})
+	}
+	download := func() {
+		op := planCreate
+		if _, err := os.Stat(name); err == nil {
+			op = planOverwrite
+		}
+		pl.add(planItem{Op: op, ID: a.remote.ID, Path: name, Subject: a.remote.Subject})
+	}
+
+	switch a.Op {
+	case syncUpload:
+		if a.state != nil && hasConflictMarkers(a.local) {
+			pl.add(planItem{Op: planConflict, Path: name, Subject: a.Subject, Detail: "conflict markers not resolved"})
+			return
+		}
+		upload(name, a.Subject)
+
+	case syncDownload:
+		download()
+
+	case syncDeleteRemote:
+		pl.add(planItem{Op: planTrash, ID: a.remote.ID, Path: name, Subject: a.remote.Subject, Detail: "deleted locally"})
+
+	case syncDeleteLocal:
+		detail := "deleted remotely"
+		if c.LocalDelete != localDeleteRemove {
+			detail += ", moved to " + localTrashPath(c.Dir, a.Path)
+		}
+		pl.add(planItem{Op: planDelete, Path: name, Subject: a.Subject, Detail: detail})
+
+	case syncDownloadAside:
+		pl.add(planItem{Op: planCreate, ID: a.remote.ID, Path: conflictPath(name, time.Now()), Subject: a.remote.Subject, Detail: fmt.Sprintf("%v is used by another note", a.Path)})
+
+	case syncConflict:
+		policy := c.Conflict
+		if a.state != nil {
+			merged, conflicts := merge3([]byte(a.state.Base), a.local, a.remote.Body)
+			if conflicts == 0 || policy == conflictMerge {
+				detail := fmt.Sprintf("%d conflicts", conflicts)
+				if conflicts > 0 || hasConflictMarkers(merged) {
+					detail += ", not uploaded until resolved"
+				}
+				pl.add(planItem{Op: planMerge, ID: a.remote.ID, Path: name, Subject: a.Subject, Detail: detail})
+				return
+			}
+		}
+		if policy == conflictMerge {
+			policy = conflictKeepBoth
+		}
+
+		switch policy {
+		case conflictKeepBoth:
+			aside := conflictPath(name, time.Now())
+			pl.add(planItem{Op: planCreate, ID: a.remote.ID, Path: aside, Subject: a.remote.Subject, Detail: "conflict: the remote one is kept"})
+			pl.add(planItem{Op: planInsert, Path: aside, Subject: subjectOfPath(aside)})
+			upload(name, a.Subject)
+		case conflictPreferLocal:
+			upload(name, a.Subject)
+		case conflictPreferRemote:
+			download()
+		default:
+			pl.add(planItem{Op: planConflict, ID: a.remote.ID, Path: name, Subject: a.Subject, Detail: policy})
+		}
+	}
+}
+
+// planSync decides what to do for each note.
+func planSync(state *syncState, locals map[string][]byte, remotes map[string]*note) []syncAction {
+	var actions []syncAction
+
+	seenLocal := make(map[string]bool)
+	seenRemote := make(map[string]bool)
+
+	// remotes are re-created on every upload (by pmsync put or other devices),
+	// so a note whose ID has gone is looked up by its UUID, or its subject if the UUID is lost.
+	remoteByUUID := func(uuid string) *note {
+		var latest *note
+		for _, r := range remotes {
+			if !seenRemote[r.ID] && uuid != "" && r.UUID == uuid && (latest == nil || r.Date.After(latest.Date)) {
+				latest = r
+			}
+		}
+		return latest
+	}
+	remoteBySubject := func(ns *noteState) *note {
+		for _, r := range sortedRemotes(remotes) {
+			if seenRemote[r.ID] || state.byID(r.ID) != nil || r.Subject != ns.Subject {
+				continue
+			}
+			if r.UUID != "" && r.UUID != ns.UUID && state.byUUID(r.UUID) != nil {
+				// another note
+				continue
+			}
+			return r
+		}
+		return nil
+	}
+
+	for _, ns := range state.Notes {
+		local, lok := locals[ns.Path]
+		remote, rok := remotes[ns.ID]
+		if !rok {
+			remote = remoteByUUID(ns.UUID)
+			if remote == nil {
+				remote = remoteBySubject(ns)
+			}
+			rok = remote != nil
+		}
+		seenLocal[ns.Path] = true
+		if rok {
+			seenRemote[remote.ID] = true
+		}
+
+		// renamed remotely
+		subject := ns.Subject
+		if rok {
+			subject = remote.Subject
+		}
+
+		if !lok || !rok {
+			a := syncAction{
+				Path:    ns.Path,
+				Subject: subject,
+				state:   ns,
+				local:   local,
+				remote:  remote,
+			}
+			switch {
+			case !lok && !rok:
+				a.Op = syncForget
+			case !lok && !ns.remoteChanged(remote):
+				a.Op = syncDeleteRemote
+			case !lok:
+				// edited on the other side wins over deletion
+				a.Op = syncDownload
+			case !ns.localChanged(local):
+				a.Op = syncDeleteLocal
+			default:
+				a.Op = syncUpload
+			}
+			actions = append(actions, a)
+			continue
+		}
+
+		a := syncAction{
+			Path:    ns.Path,
+			Subject: subject,
+			state:   ns,
+			local:   local,
+			remote:  remote,
+		}
+		switch {
+		case ns.changedOnBothSides(local, remote):
+			if hashContent(local) == hashContent(remote.Body) {
+				a.Op = syncLink
+			} else {
+				a.Op = syncConflict
+			}
+		case ns.localChanged(local):
+			a.Op = syncUpload
+		case ns.remoteChanged(remote):
+			a.Op = syncDownload
+		default:
+			continue
+		}
+		actions = append(actions, a)
+	}
+
+	// file names are taken by known notes and local files
+	names := make(nameTable)
+	for _, ns := range state.Notes {
+		names.take(ns.Path, ns.Subject)
+	}
+	for path := range locals {
+		if !seenLocal[path] {
+			names.take(path, subjectOfPath(path))
+		}
+	}
+
+	// new remotes
+	for _, r := range sortedRemotes(remotes) {
+		if seenRemote[r.ID] {
+			continue
+		}
+		seenRemote[r.ID] = true
+
+		path := names.filename("{subject}.txt", r.Subject)
+		a := syncAction{
+			Path:    path,
+			Subject: r.Subject,
+			remote:  r,
+		}
+		local, ok := locals[path]
+		switch {
+		case seenLocal[path]:
+			a.Op = syncDownloadAside
+		case ok && hashContent(local) == hashContent(r.Body):
+			a.local = local
+			a.Op = syncLink
+		case ok:
+			a.local = local
+			a.Op = syncConflict
+		default:
+			a.Op = syncDownload
+		}
+		seenLocal[path] = true
+		actions = append(actions, a)
+	}
+
+	// new locals
+	paths := make([]string, 0, len(locals))
+	for path := range locals {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if seenLocal[path] {
+			continue
+		}
+		actions = append(actions, syncAction{
+			Op:      syncUpload,
+			Path:    path,
+			Subject: subjectOfPath(path),
+			local:   locals[path],
+		})
+	}
+
+	return actions
+}
+
+// localTrashPath returns a path in localTrashDir to move path into.
+func localTrashPath(dir, path string) string {
+	dest := filepath.Join(dir, localTrashDir, path)
+	if _, err := os.Stat(dest); err != nil {
+		return dest
+	}
+	return conflictPath(dest, time.Now())
+}
+
+func sortedRemotes(remotes map[string]*note) []*note {
+	list := make([]*note, 0, len(remotes))
+	for _, r := range remotes {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// readLocalNotes reads *.txt in dir, in UTF-8.
+// A missing dir results in no notes.
+func readLocalNotes(dir string, codec localCodec) (map[string][]byte, error) {
+	locals := make(map[string][]byte)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return locals, nil
+		}
+		return nil, fmt.Errorf("read %v: %v", dir, err)
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".txt") {
+			continue
+		}
+
+		name := filepath.Join(dir, e.Name())
+		content, err := codec.readFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("read %v: %v", name, err)
+		}
+		locals[e.Name()] = content
+	}
+
+	return locals, nil
+}
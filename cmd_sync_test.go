@@ -0,0 +1,279 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syncedNotes returns a directory synchronized with notes a, b, c and d, and their message IDs.
+func syncedNotes(t *testing.T) (string, *fakeGmail, globalCmd, map[string]string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	ids := make(map[string]string)
+	for _, subject := range []string{"a", "b", "c", "d"} {
+		ids[subject] = f.addNote(testLabel, subject, subject+" body\n", time.Now())
+	}
+	g := useFakeGmail(t, f)
+
+	sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+	if _, err := sc.sync(g); err != nil {
+		t.Fatal(err)
+	}
+	return dir, f, g, ids
+}
+
+func TestSyncMaxDelete(t *testing.T) {
+	dir, f, g, _ := syncedNotes(t)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		os.Remove(filepath.Join(dir, name))
+	}
+
+	sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+	if _, err := sc.sync(g); err == nil || !strings.Contains(err.Error(), "--max-delete") {
+		t.Errorf("refusal expected, got %v", err)
+	}
+	if got := f.notes(testLabel); len(got) != 4 {
+		t.Errorf("trashed: %v", got)
+	}
+
+	// warned, but planned
+	sc.DryRun = true
+	var out string
+	stderr := captureStderr(t, func() error {
+		out = captureStdout(t, func() error {
+			_, err := sc.sync(g)
+			return err
+		})
+		return nil
+	})
+	if !strings.Contains(stderr, "WARNING") || !strings.Contains(stderr, "--max-delete") {
+		t.Errorf("stderr: %q", stderr)
+	}
+	if n := strings.Count(out, "deleted locally"); n != 3 {
+		t.Errorf("plan: %q", out)
+	}
+	if got := f.notes(testLabel); len(got) != 4 {
+		t.Errorf("trashed in dry-run: %v", got)
+	}
+
+	sc.DryRun = false
+	sc.MaxDelete = 100
+	if _, err := sc.sync(g); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.notes(testLabel); len(got) != 1 || got["d"] == "" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestSyncLocalDelete(t *testing.T) {
+	tests := []struct {
+		localDelete string
+		wantTrashed []string // contents in localTrashDir
+	}{
+		{localDeleteTrash, []string{"a body\n", "old a\n"}},
+		{localDeleteRemove, []string{"old a\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.localDelete, func(t *testing.T) {
+			dir, f, g, ids := syncedNotes(t)
+			f.TrashMessage("me", ids["a"])
+
+			// a file of the same name trashed before
+			trash := filepath.Join(dir, localTrashDir)
+			os.MkdirAll(trash, os.ModePerm)
+			os.WriteFile(filepath.Join(trash, "a.txt"), []byte("old a\n"), 0644)
+
+			sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: tt.localDelete, MaxDelete: 50, PlanFormat: "text"}
+			if _, err := sc.sync(g); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+				t.Error("a.txt: not deleted")
+			}
+			entries, _ := os.ReadDir(trash)
+			var trashed []string
+			for _, e := range entries {
+				b, _ := os.ReadFile(filepath.Join(trash, e.Name()))
+				trashed = append(trashed, string(b))
+			}
+			if strings.Join(trashed, "|") != strings.Join(tt.wantTrashed, "|") {
+				t.Errorf("trashed: got %q, want %q", trashed, tt.wantTrashed)
+			}
+		})
+	}
+}
+
+func TestSyncEditWinsOverDeletion(t *testing.T) {
+	tests := []struct {
+		name                      string
+		deleteLocal, deleteRemote bool
+		editLocal, editRemote     bool
+	}{
+		{name: "deleted locally, edited remotely", deleteLocal: true, editRemote: true},
+		{name: "deleted remotely, edited locally", deleteRemote: true, editLocal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, f, g, ids := syncedNotes(t)
+			name := filepath.Join(dir, "b.txt")
+
+			if tt.deleteLocal {
+				os.Remove(name)
+			}
+			if tt.editLocal {
+				os.WriteFile(name, []byte("edited\n"), 0644)
+			}
+			if tt.deleteRemote || tt.editRemote {
+				f.TrashMessage("me", ids["b"])
+			}
+			if tt.editRemote {
+				f.addNote(testLabel, "b", "edited\n", time.Now().Add(time.Minute))
+			}
+
+			sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+			if _, err := sc.sync(g); err != nil {
+				t.Fatal(err)
+			}
+
+			if b, _ := os.ReadFile(name); string(b) != "edited\n" {
+				t.Errorf("local: got %q", b)
+			}
+			if got := f.notes(testLabel); got["b"] != "edited\n" || len(got) != 4 {
+				t.Errorf("remote: got %v", got)
+			}
+			if _, err := os.Stat(filepath.Join(dir, localTrashDir)); err == nil {
+				t.Error("moved to the trash")
+			}
+		})
+	}
+}
+
+func TestPlanSyncSyncedNote(t *testing.T) {
+	tests := []struct {
+		name        string
+		base, local string // base is synced as m1
+		remote      *note
+
+		want string // op, empty if nothing to do
+	}{
+		{name: "unchanged", base: "base", local: "base", remote: &note{ID: "m1", Body: []byte("base")}},
+		{name: "line endings only", base: "base\n", local: "base\r\n", remote: &note{ID: "m1", Body: []byte("base\n")}},
+		{name: "edited locally", base: "base", local: "edited", remote: &note{ID: "m1", Body: []byte("base")}, want: syncUpload},
+		{name: "edited remotely", base: "base", local: "base", remote: &note{ID: "m2", Body: []byte("edited")}, want: syncDownload},
+		{name: "edited remotely in place", base: "base", local: "base", remote: &note{ID: "m1", Body: []byte("edited")}, want: syncDownload},
+		{name: "the same edit", base: "base", local: "edited", remote: &note{ID: "m2", Body: []byte("edited")}, want: syncLink},
+		{name: "edited on both sides", base: "base", local: "local", remote: &note{ID: "m2", Body: []byte("remote")}, want: syncConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &syncState{Notes: []*noteState{{
+				ID:         "m1",
+				Path:       "memo.txt",
+				Subject:    "memo",
+				LocalHash:  hashContent([]byte(tt.base)),
+				RemoteHash: hashContent([]byte(tt.base)),
+				Base:       tt.base,
+			}}}
+			tt.remote.Subject = "memo"
+			locals := map[string][]byte{"memo.txt": []byte(tt.local)}
+			remotes := map[string]*note{tt.remote.ID: tt.remote}
+
+			actions := planSync(state, locals, remotes)
+			switch {
+			case tt.want == "" && len(actions) != 0:
+				t.Errorf("got %+v, want nothing", actions)
+			case tt.want != "" && (len(actions) != 1 || actions[0].Op != tt.want || actions[0].remote != tt.remote):
+				t.Errorf("got %+v, want %v", actions, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSyncedNote(t *testing.T) {
+	dir, f, g, ids := syncedNotes(t)
+	sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+
+	// nothing to do
+	rep, err := sc.sync(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Actions != 0 {
+		t.Errorf("unchanged: %v actions", rep.Actions)
+	}
+
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a edited\n"), 0644)
+	f.TrashMessage("me", ids["b"])
+	f.addNote(testLabel, "b", "b edited\n", time.Now().Add(time.Minute))
+
+	rep, err = sc.sync(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Actions != 2 {
+		t.Errorf("%v actions", rep.Actions)
+	}
+	if got := f.notes(testLabel); got["a"] != "a edited\n" || len(got) != 4 {
+		t.Errorf("remote: got %v", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "b.txt")); string(b) != "b edited\n" {
+		t.Errorf("b.txt: got %q", b)
+	}
+
+	// the uploaded message is recorded
+	state, err := loadSyncState(filepath.Join(dir, stateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := state.byPath("a.txt")
+	if ns == nil || ns.ID == ids["a"] || ns.RemoteHash != hashContent([]byte("a edited\n")) || ns.LocalHash != ns.RemoteHash {
+		t.Fatalf("state: %+v", ns)
+	}
+	if _, found := f.messages[ns.ID]; !found {
+		t.Errorf("no message %v", ns.ID)
+	}
+
+	rep, err = sc.sync(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Actions != 0 {
+		t.Errorf("synced: %v actions", rep.Actions)
+	}
+}
+
+func TestSyncSkipsUnreadable(t *testing.T) {
+	dir, f, g, ids := syncedNotes(t)
+	f.broken = map[string]bool{ids["a"]: true}
+	f.addNote(testLabel, "e", "e body\n", time.Now())
+
+	sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+	captureStderr(t, func() error {
+		_, err := sc.sync(g)
+		return err
+	})
+
+	// not taken as deleted
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Error(err)
+	}
+	state, err := loadSyncState(filepath.Join(dir, stateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := state.byPath("a.txt"); ns == nil || ns.ID != ids["a"] {
+		t.Errorf("state: %+v", ns)
+	}
+
+	// the others are synced
+	if b, _ := os.ReadFile(filepath.Join(dir, "e.txt")); string(b) != "e body\n" {
+		t.Errorf("e.txt: got %q", b)
+	}
+}
@@ -1,19 +1,12 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/shu-go/gli"
-	"golang.org/x/xerrors"
-	gmail "google.golang.org/api/gmail/v1"
-	"google.golang.org/api/option"
 )
 
 type trashCmd struct {
@@ -23,128 +16,68 @@ type trashCmd struct {
 
 	Format string      `cli:"format,f" default:"{id} {subject} ({date})" help:"{id}, {subject}, {date}, {snippet}, {body}"`
 	Sort   gli.StrList `cli:"sort" default:"-date,subject,id" help:"sort criteria that is a list of [id, subject, date, snippet] (- means descending order)"`
+
+	DryRun     bool   `cli:"dry-run,n" help:"print IDs to be trashed, without changing anything"`
+	PlanFormat string `cli:"plan-format=FORMAT" default:"text" help:"format of --dry-run {text,json}"`
 }
 
 func (c trashCmd) Run(g globalCmd, args []string) error {
 	if len(c.IDs) == 0 && len(args) == 0 {
 		return errors.New("--id or args are required")
 	}
-
-	config, err := getConfig(g.Credentials, g.ClientID, g.ClientSecret)
-	if err != nil {
-		return xerrors.Errorf("failed to get config: %v", err)
+	if err := checkPlanFormat(c.PlanFormat); err != nil {
+		return err
 	}
 
-	/*client*/
-	_, token, err := getClient(config, g.Token, g.AuthPort)
+	store, err := openNoteStore(g)
 	if err != nil {
-		return xerrors.Errorf("failed to connect services: %v", err)
-	}
-
-	ctx := context.Background()
-	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(config.TokenSource(ctx, token)))
-	if err != nil {
-		return xerrors.Errorf("failed to instantiate a gmail service: %v", err)
-	}
-
-	// check for label Notes/pomera_sync
-	var pomeraSync *gmail.Label
-	{
-		labelsService := gmail.NewUsersLabelsService(gmailService)
-		resp, err := labelsService.List(g.UserID).Do()
-		if err != nil {
-			return err
-		}
-		for _, lbl := range resp.Labels {
-			if lbl.Name == g.Label {
-				pomeraSync = lbl
-			}
-		}
-		if pomeraSync == nil {
-			return fmt.Errorf("Label %q not found", g.Label)
-		}
+		return err
 	}
+	defer store.Close()
 
 	list := make([]listItem, 0, 4)
+	var pl plan
 
 	// list messages
 	{
 		idset := make(map[string]struct{})
-		for _, id := range c.IDs {
-			idset[id] = struct{}{}
+		add := func(n *note) {
+			if _, found := idset[n.ID]; !found {
+				idset[n.ID] = struct{}{}
+				list = append(list, newListItem(c.Format, n))
+			}
 		}
 
-		msgService := gmail.NewUsersMessagesService(gmailService)
-
 		q := strings.Join(args, " ")
 		if q != "" {
-			resp, err := msgService.List(g.UserID).LabelIds(pomeraSync.Id).Q(q).Do()
+			notes, _, err := store.List(q, 0)
 			if err != nil {
 				return err
 			}
-			for _, msg := range resp.Messages {
-				idset[msg.Id] = struct{}{}
+			for _, n := range notes {
+				add(n)
 			}
 		}
 
-		wg := sync.WaitGroup{}
-		mut := sync.Mutex{}
-
-		for id := range idset {
-			wg.Add(1)
-			go func(id string) {
-				//m, err := msgService.Get(c.LoginID, msg.Id).Format("metadata").Do()
-				m, err := msgService.Get(g.UserID, id).Format("full").Do()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-					return
-				}
-
-				content := c.Format
-				content = strings.ReplaceAll(content, "{id}", id)
-				if strings.Contains(content, "{subject}") {
-					content = strings.ReplaceAll(content, "{subject}", getHeader(m.Payload.Headers, "Subject"))
-				}
-				if strings.Contains(content, "{headers}") {
-					content = strings.ReplaceAll(content, "{headers}", fmt.Sprintf("%#v", m.Payload.Headers))
-				}
-				if strings.Contains(content, "{date}") {
-					content = strings.ReplaceAll(content, "{date}", getHeader(m.Payload.Headers, "Date"))
-				}
-				if strings.Contains(content, "{snippet}") {
-					content = strings.ReplaceAll(content, "{snippet}", m.Snippet)
-				}
-				if strings.Contains(c.Format, "{body}") {
-					decoded, err := base64.URLEncoding.DecodeString(m.Payload.Body.Data)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-						return
-					}
-					content = strings.ReplaceAll(content, "{body}", string(decoded))
-				}
-
-				dt, err := time.Parse(time.RFC822Z, getHeader(m.Payload.Headers, "Date"))
-				if err != nil {
-					dt = time.Now()
-				}
-
-				mut.Lock()
-				list = append(list, listItem{
-					Content: content,
-					ID:      m.Id,
-					Subject: getHeader(m.Payload.Headers, "Subject"),
-					Date:    dt,
-					Snippet: m.Snippet,
-				})
-				mut.Unlock()
-
-				wg.Done()
-			}(id)
+		for _, id := range c.IDs {
+			if _, found := idset[id]; found {
+				continue
+			}
+			n, err := store.Get(id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				continue
+			}
+			add(n)
 		}
-		wg.Wait()
 
 		sortListItems(list, c.Sort)
 		for _, item := range list {
+			if c.DryRun {
+				pl.add(planItem{Op: planTrash, ID: item.ID, Subject: item.Subject})
+				continue
+			}
+
 			fmt.Println(item.Content)
 
 			if c.Confirm {
@@ -157,12 +90,16 @@ func (c trashCmd) Run(g globalCmd, args []string) error {
 				}
 			}
 
-			_, err = msgService.Trash(g.UserID, item.ID).Do()
+			err = store.Trash(item.ID)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	if c.DryRun {
+		return pl.print(os.Stdout, c.PlanFormat)
+	}
+
 	return nil
 }
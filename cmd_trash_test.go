@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrashCmd(t *testing.T) {
+	tests := []struct {
+		name   string
+		ids    []int // indices of notes
+		args   []string
+		dryRun bool
+
+		want map[string]string
+	}{
+		{
+			name: "by id",
+			ids:  []int{0},
+			want: map[string]string{"diary 2023": "last year", "todo": "buy milk"},
+		},
+		{
+			name: "by query",
+			args: []string{"subject:(diary)"},
+			want: map[string]string{"todo": "buy milk"},
+		},
+		{
+			name: "both",
+			ids:  []int{2, 2},
+			args: []string{"last"},
+			want: map[string]string{"diary": "today"},
+		},
+		{
+			name:   "dry-run",
+			ids:    []int{0},
+			dryRun: true,
+			want:   map[string]string{"diary": "today", "diary 2023": "last year", "todo": "buy milk"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGmail(testLabel)
+			ids := []string{
+				f.addNote(testLabel, "diary", "today", time.Now()),
+				f.addNote(testLabel, "diary 2023", "last year", time.Now()),
+				f.addNote(testLabel, "todo", "buy milk", time.Now()),
+			}
+			g := useFakeGmail(t, f)
+
+			cmd := trashCmd{
+				Format:     "{id} {subject}",
+				Sort:       []string{"id"},
+				DryRun:     tt.dryRun,
+				PlanFormat: "json",
+			}
+			for _, i := range tt.ids {
+				cmd.IDs = append(cmd.IDs, ids[i])
+			}
+
+			out := captureStdout(t, func() error {
+				return cmd.Run(g, tt.args)
+			})
+
+			if got := f.notes(testLabel); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.dryRun && !strings.Contains(out, `"op": "trash"`) {
+				t.Errorf("no plan: %q", out)
+			}
+		})
+	}
+}
+
+func TestTrashCmdRequiresTarget(t *testing.T) {
+	g := useFakeGmail(t, newFakeGmail(testLabel))
+	if err := (trashCmd{PlanFormat: "text"}).Run(g, nil); err == nil {
+		t.Error("error expected")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type watchCmd struct {
+	Dir string `cli:"dir,d" default:"./pomera_sync" help:"local directory to be watched and synchronized"`
+
+	Delay    time.Duration `cli:"delay=DURATION" default:"3s" help:"wait for writes to settle before pushing changed files"`
+	Interval time.Duration `cli:"interval=DURATION" default:"5m" help:"interval to pull changes of notes"`
+
+	Conflict    string `cli:"conflict=POLICY" default:"merge" help:"how to resolve notes changed on both sides, after merging non-overlapping changes {merge,keep-both,prefer-local,prefer-remote}"`
+	LocalDelete string `cli:"local-delete=HOW" default:"trash" help:"how to delete files whose notes are deleted {trash,remove}"`
+	MaxDelete   int    `cli:"max-delete=PERCENT" default:"50" help:"refuse to sync if more than PERCENT% of notes would be deleted"`
+}
+
+func (c watchCmd) Run(g globalCmd) error {
+	if c.Conflict == conflictPrompt {
+		return fmt.Errorf("--conflict %v is not available in watch", conflictPrompt)
+	}
+	if c.Delay <= 0 || c.Interval <= 0 {
+		return fmt.Errorf("--delay and --interval must be positive")
+	}
+
+	// a sync in progress is completed before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sc := syncCmd{
+		Dir:         c.Dir,
+		Conflict:    c.Conflict,
+		LocalDelete: c.LocalDelete,
+		MaxDelete:   c.MaxDelete,
+		PlanFormat:  "text",
+	}
+	w := &dirWatcher{
+		dir:      filepath.Clean(c.Dir),
+		delay:    c.Delay,
+		interval: c.Interval,
+		recheck:  5 * time.Second,
+		sync: func() error {
+			return sc.Run(g)
+		},
+	}
+	return w.run(ctx)
+}
+
+// dirWatcher calls sync when files in dir are changed, and at intervals.
+//
+// dir may be removed and come back, like a folder on an SD card.
+// While it is not available, sync is not called, not to take the missing files as deleted.
+type dirWatcher struct {
+	dir      string
+	delay    time.Duration // debounce of changes
+	interval time.Duration // polling remote changes
+	recheck  time.Duration // checking if dir is available
+	sync     func() error
+
+	hasState bool // dir has been seen with the sync state
+}
+
+func (w *dirWatcher) run(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch: %v", err)
+	}
+	defer fw.Close()
+
+	pending := time.NewTimer(w.delay)
+	pending.Stop()
+	debouncing := false
+	trigger := func(d time.Duration) {
+		pending.Reset(d)
+		debouncing = true
+	}
+
+	poll := time.NewTicker(w.interval)
+	defer poll.Stop()
+	recheck := time.NewTicker(w.recheck)
+	defer recheck.Stop()
+
+	if w.checkDir(fw) {
+		trigger(0)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(os.Stderr, "stopped watching: %v\n", w.dir)
+			return nil
+
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) == w.dir {
+				// removed or unmounted, checked soon
+				if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+					fw.Remove(w.dir)
+					fmt.Fprintf(os.Stderr, "waiting for %v to come back\n", w.dir)
+				}
+				continue
+			}
+			if w.isNoteFile(ev.Name) && !ev.Has(fsnotify.Chmod) {
+				trigger(w.delay)
+			}
+
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "ERROR: watch: %v\n", err)
+
+		case <-recheck.C:
+			// the files may be changed while not watched
+			if w.checkDir(fw) {
+				trigger(w.delay)
+			}
+
+		case <-poll.C:
+			if !debouncing {
+				trigger(0)
+			}
+
+		case <-pending.C:
+			debouncing = false
+			if !w.available() {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "syncing: %v (%v)\n", w.dir, time.Now().Format(time.RFC3339))
+			if err := w.sync(); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			}
+		}
+	}
+}
+
+// checkDir starts or stops watching dir by its availability.
+// It reports whether watching is started.
+func (w *dirWatcher) checkDir(fw *fsnotify.Watcher) bool {
+	watched := containsString(fw.WatchList(), w.dir)
+	available := w.available()
+
+	switch {
+	case watched && !available:
+		fw.Remove(w.dir)
+		fmt.Fprintf(os.Stderr, "waiting for %v to come back\n", w.dir)
+
+	case !watched && available:
+		if err := fw.Add(w.dir); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: watch %v: %v\n", w.dir, err)
+			return false
+		}
+		fmt.Fprintf(os.Stderr, "watching: %v\n", w.dir)
+		return true
+	}
+	return false
+}
+
+// available reports whether dir is there.
+// Once the sync state has been seen, dir without it is taken as an empty mount point.
+func (w *dirWatcher) available() bool {
+	fi, err := os.Stat(w.dir)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(w.dir, stateFileName)); err == nil {
+		w.hasState = true
+		return true
+	}
+	return !w.hasState
+}
+
+// isNoteFile reports whether name is a file to be synchronized, as readLocalNotes reads.
+func (w *dirWatcher) isNoteFile(name string) bool {
+	return filepath.Dir(filepath.Clean(name)) == w.dir &&
+		filepath.Base(name) != stateFileName &&
+		strings.EqualFold(filepath.Ext(name), ".txt")
+}
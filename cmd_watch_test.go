@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirWatcher(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "pomera_sync")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, stateFileName), []byte(`{"notes":[]}`), 0644)
+
+	synced := make(chan struct{}, 100)
+	w := &dirWatcher{
+		dir:      dir,
+		delay:    50 * time.Millisecond,
+		interval: time.Hour,
+		recheck:  20 * time.Millisecond,
+		sync: func() error {
+			synced <- struct{}{}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.run(ctx)
+	}()
+
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-synced:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: not synced", what)
+		}
+	}
+	quiet := func(what string) {
+		t.Helper()
+		select {
+		case <-synced:
+			t.Fatalf("%v: synced", what)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	wait("start")
+
+	// a burst of writes results in a sync
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(dir, "memo.txt"), []byte("hello"), 0644)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wait("write")
+	quiet("after write")
+
+	os.WriteFile(filepath.Join(dir, "image.png"), []byte("png"), 0644)
+	quiet("not a note")
+
+	// unmounted, and mounted again
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	quiet("removed")
+	os.Mkdir(dir, 0755)
+	quiet("empty mount point")
+	os.WriteFile(filepath.Join(dir, stateFileName), []byte(`{"notes":[]}`), 0644)
+	wait("mounted")
+
+	os.WriteFile(filepath.Join(dir, "memo.txt"), []byte("hello again"), 0644)
+	wait("write after mounted")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped")
+	}
+}
+
+func TestDirWatcherPoll(t *testing.T) {
+	dir := t.TempDir()
+
+	synced := make(chan struct{}, 100)
+	w := &dirWatcher{
+		dir:      dir,
+		delay:    time.Hour,
+		interval: 30 * time.Millisecond,
+		recheck:  time.Hour,
+		sync: func() error {
+			synced <- struct{}{}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-synced:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("#%d: not synced", i)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// conflict policies
+// They apply to notes changed on both sides since the last sync.
+const (
+	conflictKeepBoth     = "keep-both"     // keep the local file, and write the remote one as a sibling
+	conflictPreferLocal  = "prefer-local"  // overwrite the remote one
+	conflictPreferRemote = "prefer-remote" // overwrite the local one
+	conflictPrompt       = "prompt"        // ask for each conflict
+	conflictMerge        = "merge"         // merge with conflict markers (sync only)
+	conflictSkip         = "skip"          // chosen in prompt
+)
+
+func checkConflictPolicy(policy string) error {
+	switch policy {
+	case conflictKeepBoth, conflictPreferLocal, conflictPreferRemote, conflictPrompt:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+// resolveConflict returns how to resolve the conflict of the note at path.
+// If policy is prompt, the user is asked.
+func resolveConflict(policy, path string) string {
+	if policy != conflictPrompt {
+		return policy
+	}
+
+	for {
+		var answer string
+		fmt.Fprintf(os.Stderr, "%v was changed on both sides. keep [b]oth, prefer [l]ocal, prefer [r]emote or [s]kip? [b/l/r/S]", path)
+		n, err := fmt.Scanln(&answer)
+		if err != nil || n == 0 || len(answer) < 1 {
+			return conflictSkip
+		}
+
+		switch strings.ToLower(answer)[0] {
+		case 'b':
+			return conflictKeepBoth
+		case 'l':
+			return conflictPreferLocal
+		case 'r':
+			return conflictPreferRemote
+		case 's':
+			return conflictSkip
+		}
+	}
+}
+
+// conflictPath returns a sibling path of path to hold the other side of a conflict.
+//
+//	memo.txt -> memo.conflict-20210101-150405.txt
+func conflictPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	name := fmt.Sprintf("%s.conflict-%s%s", base, t.Format("20060102-150405"), ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(name); err != nil {
+			return name
+		}
+		name = fmt.Sprintf("%s.conflict-%s-%d%s", base, t.Format("20060102-150405"), i, ext)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diffLine is a line of an edit script, which is kept (' '), deleted ('-') or inserted ('+').
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines returns the edit script from a to b, by their longest common subsequence.
+func diffLines(a, b []string) []diffLine {
+	match := lcsMatch(a, b)
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	j := 0
+	for i := range a {
+		if match[i] < 0 {
+			lines = append(lines, diffLine{'-', a[i]})
+			continue
+		}
+		for ; j < match[i]; j++ {
+			lines = append(lines, diffLine{'+', b[j]})
+		}
+		lines = append(lines, diffLine{' ', a[i]})
+		j++
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
+
+// diffStat returns the numbers of inserted and deleted lines.
+func diffStat(lines []diffLine) (inserted, deleted int) {
+	for _, l := range lines {
+		switch l.op {
+		case '+':
+			inserted++
+		case '-':
+			deleted++
+		}
+	}
+	return inserted, deleted
+}
+
+// writeUnifiedDiff writes lines in the unified format, with context lines around changes.
+// Nothing is written if there is no change.
+func writeUnifiedDiff(w io.Writer, from, to string, lines []diffLine, context int) {
+	if context < 0 {
+		context = 0
+	}
+
+	// line numbers in a and b before each line
+	posA := make([]int, len(lines)+1)
+	posB := make([]int, len(lines)+1)
+	for k, l := range lines {
+		posA[k+1], posB[k+1] = posA[k], posB[k]
+		if l.op != '+' {
+			posA[k+1]++
+		}
+		if l.op != '-' {
+			posB[k+1]++
+		}
+	}
+
+	header := false
+	k := 0
+	for {
+		for k < len(lines) && lines[k].op == ' ' {
+			k++
+		}
+		if k == len(lines) {
+			break
+		}
+
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for {
+			for end < len(lines) && lines[end].op != ' ' {
+				end++
+			}
+			// changes close enough share a hunk
+			next := end
+			for next < len(lines) && lines[next].op == ' ' && next-end < 2*context {
+				next++
+			}
+			if next < len(lines) && lines[next].op != ' ' {
+				end = next
+				continue
+			}
+			end += context
+			if end > len(lines) {
+				end = len(lines)
+			}
+			break
+		}
+
+		if !header {
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+			header = true
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(posA[start], posA[end]), hunkRange(posB[start], posB[end]))
+		for _, l := range lines[start:end] {
+			fmt.Fprintf(w, "%c%s\n", l.op, l.text)
+		}
+		k = end
+	}
+}
+
+// hunkRange formats lines [from, to) (0-based) as a range of a hunk header.
+func hunkRange(from, to int) string {
+	switch n := to - from; n {
+	case 0:
+		return fmt.Sprintf("%d,0", from)
+	case 1:
+		return fmt.Sprintf("%d", from+1)
+	default:
+		return fmt.Sprintf("%d,%d", from+1, n)
+	}
+}
+
+// statBar returns pluses and minuses of inserted and deleted lines, scaled down to width.
+func statBar(inserted, deleted, width int) string {
+	if total := inserted + deleted; total > width {
+		ins := inserted * width / total
+		if inserted > 0 && ins == 0 {
+			ins = 1
+		}
+		inserted, deleted = ins, width-ins
+	}
+	return strings.Repeat("+", inserted) + strings.Repeat("-", deleted)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+
+		want string
+	}{
+		{
+			name: "same",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name:    "replaced",
+			a:       "1\n2\n3\n4\n5\n",
+			b:       "1\n2\nthree\n4\n5\n",
+			context: 1,
+			want: "--- a\n+++ b\n" +
+				"@@ -2,3 +2,3 @@\n 2\n-3\n+three\n 4\n",
+		},
+		{
+			name:    "separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n",
+			b:       "one\n2\n3\n4\n5\n6\nseven\n",
+			context: 1,
+			want: "--- a\n+++ b\n" +
+				"@@ -1,2 +1,2 @@\n-1\n+one\n 2\n" +
+				"@@ -6,2 +6,2 @@\n 6\n-7\n+seven\n",
+		},
+		{
+			name:    "joined hunks",
+			a:       "1\n2\n3\n4\n",
+			b:       "one\n2\n3\nfour\n",
+			context: 1,
+			want: "--- a\n+++ b\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n-4\n+four\n",
+		},
+		{
+			name:    "new",
+			a:       "",
+			b:       "hello\n",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -0,0 +1 @@\n+hello\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			writeUnifiedDiff(&sb, "a", "b", diffLines(splitLines([]byte(tt.a)), splitLines([]byte(tt.b))), tt.context)
+			if got := sb.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatBar(t *testing.T) {
+	tests := []struct {
+		inserted, deleted, width int
+		want                     string
+	}{
+		{2, 1, 10, "++-"},
+		{30, 10, 8, "++++++--"},
+		{100, 1, 4, "+++-"},
+		{1, 100, 4, "+---"},
+	}
+	for _, tt := range tests {
+		if got := statBar(tt.inserted, tt.deleted, tt.width); got != tt.want {
+			t.Errorf("statBar(%v, %v, %v): got %q, want %q", tt.inserted, tt.deleted, tt.width, got, tt.want)
+		}
+	}
+}
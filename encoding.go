@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// local encodings
+const (
+	encodingUTF8     = "utf-8"
+	encodingUTF8BOM  = "utf-8-bom"
+	encodingShiftJIS = "shift_jis"
+	encodingEUCJP    = "euc-jp"
+	encodingAuto     = "auto" // detected for each file
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// line ending policies
+const (
+	eolPreserve = "preserve"
+	eolCRLF     = "crlf"
+	eolLF       = "lf"
+)
+
+// localCodec reads and writes local files in an encoding.
+// Contents are UTF-8 in memory, as they are in notes.
+//
+// Line endings are converted by the policy on both reading (to be put) and writing (got).
+type localCodec struct {
+	name string
+	eol  string
+}
+
+func newLocalCodec(name, eol string) (localCodec, error) {
+	c := localCodec{eol: strings.ToLower(eol)}
+	switch c.eol {
+	case "":
+		c.eol = eolPreserve
+	case eolPreserve, eolCRLF, eolLF:
+	default:
+		return localCodec{}, fmt.Errorf("unknown --eol %q", eol)
+	}
+
+	switch n := strings.ToLower(name); n {
+	case "", "utf8":
+		c.name = encodingUTF8
+	case encodingUTF8, encodingUTF8BOM, encodingShiftJIS, encodingEUCJP, encodingAuto:
+		c.name = n
+	case "sjis", "shift-jis", "cp932":
+		c.name = encodingShiftJIS
+	case "eucjp", "euc_jp":
+		c.name = encodingEUCJP
+	default:
+		return localCodec{}, fmt.Errorf("unknown --local-encoding %q", name)
+	}
+	return c, nil
+}
+
+// readFile reads a local file in UTF-8.
+func (c localCodec) readFile(name string) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return convertEOL(c.decode(b), c.eol), nil
+}
+
+// writeFile writes content to a local file in the encoding.
+// In auto, the encoding of the existing file is kept, or UTF-8 for a new file.
+func (c localCodec) writeFile(name string, content []byte) error {
+	enc := c.name
+	if enc == encodingAuto {
+		enc = encodingUTF8
+		if orig, err := os.ReadFile(name); err == nil {
+			enc = detectEncoding(orig)
+		}
+	}
+
+	b, err := encodeLocal(enc, convertEOL(content, c.eol))
+	if err != nil {
+		if uerr, ok := err.(*unencodableError); ok {
+			uerr.name = name
+		}
+		return err
+	}
+
+	if dir := filepath.Dir(name); dir != "" {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("mkdir %v: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		return fmt.Errorf("create %v: %v", name, err)
+	}
+	return nil
+}
+
+// decode converts the content of a local file into UTF-8.
+func (c localCodec) decode(b []byte) []byte {
+	enc := c.name
+	if enc == encodingAuto {
+		enc = detectEncoding(b)
+	}
+
+	switch enc {
+	case encodingShiftJIS:
+		b, _ = japanese.ShiftJIS.NewDecoder().Bytes(b)
+	case encodingEUCJP:
+		b, _ = japanese.EUCJP.NewDecoder().Bytes(b)
+	}
+	return bytes.TrimPrefix(b, utf8BOM)
+}
+
+func encodeLocal(enc string, content []byte) ([]byte, error) {
+	var e encoding.Encoding
+	switch enc {
+	case encodingUTF8BOM:
+		if bytes.HasPrefix(content, utf8BOM) {
+			return content, nil
+		}
+		return append(append([]byte{}, utf8BOM...), content...), nil
+	case encodingShiftJIS:
+		e = japanese.ShiftJIS
+	case encodingEUCJP:
+		e = japanese.EUCJP
+	default:
+		return content, nil
+	}
+
+	b, err := e.NewEncoder().Bytes(content)
+	if err != nil {
+		return nil, &unencodableError{enc: enc, err: err}
+	}
+	return b, nil
+}
+
+// unencodableError is returned if a content has characters not in the local encoding, like emoji in Shift_JIS.
+// Commands skip the note, not to stop the others.
+type unencodableError struct {
+	name string
+	enc  string
+	err  error
+}
+
+func (e *unencodableError) Error() string {
+	return fmt.Sprintf("%v: cannot be encoded in %v: %v", e.name, e.enc, e.err)
+}
+
+// detectEncoding guesses the encoding of b among UTF-8 (with or without BOM), Shift_JIS and EUC-JP.
+func detectEncoding(b []byte) string {
+	if bytes.HasPrefix(b, utf8BOM) {
+		return encodingUTF8BOM
+	}
+	if utf8.Valid(b) {
+		return encodingUTF8
+	}
+
+	// fewer broken or unlikely characters wins, Shift_JIS (Pomera's default) on a tie
+	score := func(e encoding.Encoding) int {
+		decoded, err := e.NewDecoder().Bytes(b)
+		if err != nil {
+			return len(b)
+		}
+		n := 0
+		for _, r := range string(decoded) {
+			switch {
+			case r == utf8.RuneError:
+				n += 10
+			case 0xff61 <= r && r <= 0xff9f:
+				// half-width katakana, which EUC-JP bytes tend to be in Shift_JIS
+				n++
+			}
+		}
+		return n
+	}
+	if score(japanese.EUCJP) < score(japanese.ShiftJIS) {
+		return encodingEUCJP
+	}
+	return encodingShiftJIS
+}
+
+// convertEOL converts line endings (CRLF, LF or CR) of b by the policy.
+func convertEOL(b []byte, eol string) []byte {
+	var to []byte
+	switch eol {
+	case eolCRLF:
+		to = []byte("\r\n")
+	case eolLF:
+		to = []byte("\n")
+	default:
+		return b
+	}
+
+	if !bytes.ContainsAny(b, "\r\n") {
+		return b
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(b) + len(b)/16)
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\r':
+			if i+1 < len(b) && b[i+1] == '\n' {
+				i++
+			}
+			buf.Write(to)
+		case '\n':
+			buf.Write(to)
+		default:
+			buf.WriteByte(b[i])
+		}
+	}
+	return buf.Bytes()
+}
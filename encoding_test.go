@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	sjisDiary = "\x93\xfa\x8bL" // 日記
+	eucDiary  = "\xc6\xfc\xb5\xad"
+)
+
+func TestLocalCodec(t *testing.T) {
+	tests := []struct {
+		encoding string
+		orig     string // existing file, for auto
+		file     string
+	}{
+		{encoding: "utf-8", file: "日記"},
+		{encoding: "utf-8-bom", file: "\xef\xbb\xbf日記"},
+		{encoding: "shift_jis", file: sjisDiary},
+		{encoding: "sjis", file: sjisDiary},
+		{encoding: "euc-jp", file: eucDiary},
+		{encoding: "auto", file: "日記"},
+		{encoding: "auto", orig: "\xef\xbb\xbfx", file: "\xef\xbb\xbf日記"},
+		{encoding: "auto", orig: sjisDiary + "\r\n" + sjisDiary, file: sjisDiary},
+		{encoding: "auto", orig: eucDiary + "\r\n" + eucDiary, file: eucDiary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			codec, err := newLocalCodec(tt.encoding, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			name := filepath.Join(t.TempDir(), "memo.txt")
+			if tt.orig != "" {
+				os.WriteFile(name, []byte(tt.orig), 0644)
+			}
+
+			if err := codec.writeFile(name, []byte("日記")); err != nil {
+				t.Fatal(err)
+			}
+			b, _ := os.ReadFile(name)
+			if string(b) != tt.file {
+				t.Errorf("file: got %q, want %q", b, tt.file)
+			}
+
+			content, err := codec.readFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "日記" {
+				t.Errorf("content: got %q", content)
+			}
+		})
+	}
+}
+
+func TestLocalCodecErrors(t *testing.T) {
+	if _, err := newLocalCodec("latin1", ""); err == nil {
+		t.Error("unknown encoding: error expected")
+	}
+
+	codec, _ := newLocalCodec("shift_jis", "")
+	if err := codec.writeFile(filepath.Join(t.TempDir(), "memo.txt"), []byte("😀")); err == nil {
+		t.Error("unsupported character: error expected")
+	}
+}
+
+func TestShiftJISRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	g := useFakeGmail(t, f)
+	g.LocalEncoding = "shift_jis"
+
+	name := filepath.Join(dir, "memo.txt")
+	os.WriteFile(name, []byte(sjisDiary), 0644)
+
+	captureStdout(t, func() error {
+		return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"memo.txt"})
+	})
+	if got := f.notes(testLabel); got["memo"] != "日記" {
+		t.Errorf("put: got %v", got)
+	}
+
+	os.Remove(name)
+	os.Remove(filepath.Join(dir, stateFileName))
+	f.addNote(testLabel, "memo", "日記2", time.Now().Add(time.Hour))
+
+	captureStdout(t, func() error {
+		return getCmd{OutputTarget: "file", OutputFormat: "{subject}.txt", OutputDest: dir, Max: 1, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, nil)
+	})
+	b, _ := os.ReadFile(name)
+	if !bytes.Equal(b, []byte(sjisDiary+"2")) {
+		t.Errorf("get: got %q", b)
+	}
+}
+
+func TestUnencodableNoteSkipped(t *testing.T) {
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "emoji", "😀", time.Now())
+	f.addNote(testLabel, "diary", "日記", time.Now().Add(-time.Hour))
+	g := useFakeGmail(t, f)
+	g.LocalEncoding = "shift_jis"
+
+	t.Run("get", func(t *testing.T) {
+		dir := t.TempDir()
+		err := getCmd{OutputTarget: "file", OutputFormat: "{subject}.txt", OutputDest: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, nil)
+		if err == nil {
+			t.Error("error expected")
+		}
+		if b, _ := os.ReadFile(filepath.Join(dir, "diary.txt")); string(b) != sjisDiary {
+			t.Errorf("diary: got %q", b)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "emoji.txt")); err == nil {
+			t.Error("emoji: written")
+		}
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		dir := t.TempDir()
+		sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+		rep, err := sc.sync(g)
+		if err == nil {
+			t.Error("error expected")
+		}
+		if rep == nil || rep.Actions != 1 || len(rep.Skipped) != 1 || rep.Skipped[0] != "emoji.txt" {
+			t.Fatalf("report: %+v", rep)
+		}
+		if b, _ := os.ReadFile(filepath.Join(dir, "diary.txt")); string(b) != sjisDiary {
+			t.Errorf("diary: got %q", b)
+		}
+
+		// not recorded, to be tried again
+		state, err := loadSyncState(filepath.Join(dir, stateFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.byPath("emoji.txt") != nil || state.byPath("diary.txt") == nil {
+			t.Errorf("state: %+v", state.Notes)
+		}
+		if rep, _ := sc.sync(g); rep == nil || len(rep.Skipped) != 1 {
+			t.Errorf("again: %+v", rep)
+		}
+	})
+}
+
+func TestConvertEOL(t *testing.T) {
+	tests := []struct {
+		in, eol, want string
+	}{
+		{"a\r\nb\nc\rd\r\n", eolLF, "a\nb\nc\nd\n"},
+		{"a\r\nb\nc\rd\r\n", eolCRLF, "a\r\nb\r\nc\r\nd\r\n"},
+		{"a\r\nb\nc\rd\r\n", eolPreserve, "a\r\nb\nc\rd\r\n"},
+		{"\r\n\r\n", eolLF, "\n\n"},
+		{"no line ending", eolCRLF, "no line ending"},
+	}
+	for _, tt := range tests {
+		if got := string(convertEOL([]byte(tt.in), tt.eol)); got != tt.want {
+			t.Errorf("convertEOL(%q, %v): got %q, want %q", tt.in, tt.eol, got, tt.want)
+		}
+	}
+
+	if hashContent([]byte("a\r\nb\r\n")) != hashContent([]byte("a\nb\n")) {
+		t.Error("hashContent should ignore line endings")
+	}
+	if hashContent([]byte("a\nb\n")) == hashContent([]byte("a\n\nb\n")) {
+		t.Error("hashContent should not ignore empty lines")
+	}
+}
+
+func TestEOLPolicy(t *testing.T) {
+	for _, eol := range []string{eolPreserve, eolCRLF, eolLF} {
+		t.Run(eol, func(t *testing.T) {
+			dir := t.TempDir()
+			f := newFakeGmail(testLabel)
+			g := useFakeGmail(t, f)
+			g.EOL = eol
+
+			os.WriteFile(filepath.Join(dir, "pomera.txt"), []byte("a\r\nb\r\n"), 0644)
+			captureStdout(t, func() error {
+				return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"pomera.txt"})
+			})
+
+			f.addNote(testLabel, "phone", "c\nd\n", time.Now())
+			captureStdout(t, func() error {
+				return getCmd{OutputTarget: "file", OutputFormat: "{subject}.txt", OutputDest: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"subject:(phone)"})
+			})
+
+			wantNote, wantFile := map[string]string{
+				eolPreserve: "a\r\nb\r\n",
+				eolCRLF:     "a\r\nb\r\n",
+				eolLF:       "a\nb\n",
+			}[eol], map[string]string{
+				eolPreserve: "c\nd\n",
+				eolCRLF:     "c\r\nd\r\n",
+				eolLF:       "c\nd\n",
+			}[eol]
+
+			if got := f.notes(testLabel)["pomera"]; got != wantNote {
+				t.Errorf("put: got %q, want %q", got, wantNote)
+			}
+			if got, _ := os.ReadFile(filepath.Join(dir, "phone.txt")); string(got) != wantFile {
+				t.Errorf("get: got %q, want %q", got, wantFile)
+			}
+		})
+	}
+}
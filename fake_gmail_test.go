@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeGmail is an in-memory gmailAPI.
+type fakeGmail struct {
+	mut sync.Mutex
+
+	labels   []*gmail.Label
+	messages map[string]*fakeMessage
+
+	historyID    uint64
+	history      []*gmail.History
+	minHistoryID uint64 // history before this is expired
+
+	nextID   int
+	pageSize int
+
+	broken map[string]bool // messages failing to be got
+
+	calls map[string]int
+}
+
+type fakeMessage struct {
+	id           string
+	raw          []byte
+	labelIDs     []string
+	internalDate time.Time
+}
+
+var _ gmailAPI = (*fakeGmail)(nil)
+
+func newFakeGmail(labelNames ...string) *fakeGmail {
+	f := &fakeGmail{
+		messages:  make(map[string]*fakeMessage),
+		historyID: 1000,
+		pageSize:  100,
+		calls:     make(map[string]int),
+	}
+	for i, name := range labelNames {
+		f.labels = append(f.labels, &gmail.Label{
+			Id:   fmt.Sprintf("Label_%d", i+1),
+			Name: name,
+			Type: "user",
+		})
+	}
+	return f
+}
+
+func (f *fakeGmail) labelID(name string) string {
+	for _, l := range f.labels {
+		if l.Name == name {
+			return l.Id
+		}
+	}
+	panic("no label " + name)
+}
+
+// addNote adds a plain text note as if it is written by another client.
+func (f *fakeGmail) addNote(labelName, subject, body string, date time.Time) string {
+	raw := "Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + date.Format(time.RFC1123Z) + "\r\n" +
+		"\r\n" +
+		body
+	return f.addRaw(labelName, raw, date)
+}
+
+// addRaw adds a message in RFC 822 format.
+func (f *fakeGmail) addRaw(labelName, raw string, date time.Time) string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	return f.insert([]byte(raw), []string{f.labelID(labelName)}, date)
+}
+
+func (f *fakeGmail) insert(raw []byte, labelIDs []string, date time.Time) string {
+	f.nextID++
+	id := fmt.Sprintf("%016x", 0x18000000+f.nextID)
+	m := &fakeMessage{
+		id:           id,
+		raw:          raw,
+		labelIDs:     append([]string(nil), labelIDs...),
+		internalDate: date,
+	}
+	f.messages[id] = m
+
+	f.record(&gmail.History{
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: f.ref(m)}},
+	})
+	return id
+}
+
+func (f *fakeGmail) record(h *gmail.History) {
+	f.historyID++
+	h.Id = f.historyID
+	f.history = append(f.history, h)
+}
+
+func (f *fakeGmail) ref(m *fakeMessage) *gmail.Message {
+	return &gmail.Message{
+		Id:       m.id,
+		ThreadId: m.id,
+		LabelIds: append([]string(nil), m.labelIDs...),
+	}
+}
+
+// expireHistory makes history before now unavailable.
+func (f *fakeGmail) expireHistory() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	f.minHistoryID = f.historyID + 1
+}
+
+// notes returns subject->body of the messages under the label, not trashed.
+func (f *fakeGmail) notes(labelName string) map[string]string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	labelID := f.labelID(labelName)
+	notes := make(map[string]string)
+	for _, m := range f.messages {
+		if !hasLabel(m, labelID) || hasLabel(m, "TRASH") {
+			continue
+		}
+		header, body := parseFakeMessage(m.raw)
+		notes[decodeFakeHeader(header.Get("Subject"))] = string(decodeFakeCTE(header.Get("Content-Transfer-Encoding"), body))
+	}
+	return notes
+}
+
+func (f *fakeGmail) count(name string) {
+	f.mut.Lock()
+	f.calls[name]++
+	f.mut.Unlock()
+}
+
+func hasLabel(m *fakeMessage, labelID string) bool {
+	for _, l := range m.labelIDs {
+		if l == labelID {
+			return true
+		}
+	}
+	return false
+}
+
+func notFound(what string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: what + " not found"}
+}
+
+func (f *fakeGmail) ListLabels(userID string) ([]*gmail.Label, error) {
+	f.count("labels.list")
+	return f.labels, nil
+}
+
+func (f *fakeGmail) CreateLabel(userID string, l *gmail.Label) (*gmail.Label, error) {
+	f.count("labels.create")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	for _, ll := range f.labels {
+		if ll.Name == l.Name {
+			return nil, &googleapi.Error{Code: http.StatusConflict, Message: "label " + l.Name + " exists"}
+		}
+	}
+	created := *l
+	created.Id = fmt.Sprintf("Label_%d", len(f.labels)+1)
+	created.Type = "user"
+	f.labels = append(f.labels, &created)
+	return &created, nil
+}
+
+func (f *fakeGmail) ListMessages(userID, labelID, q, pageToken string) (*gmail.ListMessagesResponse, error) {
+	f.count("messages.list")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	var list []*fakeMessage
+	for _, m := range f.messages {
+		if !hasLabel(m, labelID) || hasLabel(m, "TRASH") {
+			continue
+		}
+		if !matchFakeQuery(m, q) {
+			continue
+		}
+		list = append(list, m)
+	}
+	// newer first
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].internalDate.Equal(list[j].internalDate) {
+			return list[i].internalDate.After(list[j].internalDate)
+		}
+		return list[i].id > list[j].id
+	})
+
+	offset := 0
+	if pageToken != "" {
+		offset, _ = strconv.Atoi(pageToken)
+	}
+	resp := &gmail.ListMessagesResponse{ResultSizeEstimate: int64(len(list))}
+	for i := offset; i < len(list) && i < offset+f.pageSize; i++ {
+		resp.Messages = append(resp.Messages, &gmail.Message{Id: list[i].id, ThreadId: list[i].id})
+	}
+	if offset+f.pageSize < len(list) {
+		resp.NextPageToken = strconv.Itoa(offset + f.pageSize)
+	}
+	return resp, nil
+}
+
+// matchFakeQuery supports "subject:(words)", "subject:word", `subject:"phrase"`, bare words and phrases.
+func matchFakeQuery(m *fakeMessage, q string) bool {
+	header, body := parseFakeMessage(m.raw)
+	subject := strings.ToLower(decodeFakeHeader(header.Get("Subject")))
+	text := subject + "\n" + strings.ToLower(string(body))
+
+	q = strings.ToLower(q)
+	for q != "" {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			break
+		}
+
+		var words []string
+		target := text
+		inSubject := strings.HasPrefix(q, "subject:")
+		if inSubject {
+			q = strings.TrimPrefix(q, "subject:")
+			target = subject
+		}
+		if strings.HasPrefix(q, `"`) {
+			end := strings.Index(q[1:], `"`)
+			if end < 0 {
+				end = len(q) - 1
+				q += `"`
+			}
+			words = []string{q[1 : end+1]}
+			q = q[end+2:]
+		} else if inSubject && strings.HasPrefix(q, "(") {
+			end := strings.Index(q, ")")
+			if end < 0 {
+				end = len(q)
+				q += ")"
+			}
+			words = strings.Fields(q[1:end])
+			q = q[end+1:]
+		}
+		if words == nil {
+			end := strings.IndexAny(q, " \t")
+			if end < 0 {
+				end = len(q)
+			}
+			words = []string{q[:end]}
+			q = q[end:]
+		}
+
+		for _, w := range words {
+			if !strings.Contains(target, w) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *fakeGmail) GetMessage(userID, id, format string) (*gmail.Message, error) {
+	f.count("messages.get")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	m, found := f.messages[id]
+	if !found {
+		return nil, notFound("message " + id)
+	}
+	if f.broken[id] {
+		return nil, fmt.Errorf("message %v is broken", id)
+	}
+
+	header, body := parseFakeMessage(m.raw)
+	msg := f.ref(m)
+	msg.HistoryId = f.historyID
+	msg.InternalDate = m.internalDate.UnixMilli()
+	msg.SizeEstimate = int64(len(m.raw))
+	msg.Snippet = fakeSnippet(body)
+
+	switch format {
+	case "raw":
+		msg.Raw = base64.URLEncoding.EncodeToString(m.raw)
+	case "full", "":
+		msg.Payload = fakePart(header, body)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	return msg, nil
+}
+
+func fakeSnippet(body []byte) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if len([]rune(s)) > 100 {
+		s = string([]rune(s)[:100])
+	}
+	return s
+}
+
+// fakePart builds a message part as Gmail does: headers as they are, and the body without Content-Transfer-Encoding.
+func fakePart(header mail.Header, body []byte) *gmail.MessagePart {
+	part := &gmail.MessagePart{Body: &gmail.MessagePartBody{}}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			part.Headers = append(part.Headers, &gmail.MessagePartHeader{Name: k, Value: v})
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	part.MimeType = mediaType
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err != nil {
+				break
+			}
+			b, _ := io.ReadAll(p)
+			part.Parts = append(part.Parts, fakePart(mail.Header(p.Header), b))
+		}
+		return part
+	}
+
+	decoded := decodeFakeCTE(header.Get("Content-Transfer-Encoding"), body)
+	part.Body.Data = base64.URLEncoding.EncodeToString(decoded)
+	part.Body.Size = int64(len(decoded))
+	return part
+}
+
+func (f *fakeGmail) InsertMessage(userID string, msg *gmail.Message) (*gmail.Message, error) {
+	f.count("messages.insert")
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	id := f.insert(raw, msg.LabelIds, time.Now())
+	return f.ref(f.messages[id]), nil
+}
+
+func (f *fakeGmail) TrashMessage(userID, id string) error {
+	f.count("messages.trash")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	m, found := f.messages[id]
+	if !found {
+		return notFound("message " + id)
+	}
+	if !hasLabel(m, "TRASH") {
+		m.labelIDs = append(m.labelIDs, "TRASH")
+		f.record(&gmail.History{
+			LabelsAdded: []*gmail.HistoryLabelAdded{{Message: f.ref(m), LabelIds: []string{"TRASH"}}},
+		})
+	}
+	return nil
+}
+
+func (f *fakeGmail) UntrashMessage(userID, id string) error {
+	f.count("messages.untrash")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	m, found := f.messages[id]
+	if !found {
+		return notFound("message " + id)
+	}
+	for i, l := range m.labelIDs {
+		if l == "TRASH" {
+			m.labelIDs = append(m.labelIDs[:i], m.labelIDs[i+1:]...)
+			f.record(&gmail.History{
+				LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: f.ref(m), LabelIds: []string{"TRASH"}}},
+			})
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeGmail) ModifyMessage(userID, id string, addLabelIDs, removeLabelIDs []string) error {
+	f.count("messages.modify")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	m, found := f.messages[id]
+	if !found {
+		return notFound("message " + id)
+	}
+
+	var removed []string
+	labelIDs := m.labelIDs[:0]
+	for _, l := range m.labelIDs {
+		if containsString(removeLabelIDs, l) {
+			removed = append(removed, l)
+			continue
+		}
+		labelIDs = append(labelIDs, l)
+	}
+	m.labelIDs = labelIDs
+	if len(removed) > 0 {
+		f.record(&gmail.History{
+			LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: f.ref(m), LabelIds: removed}},
+		})
+	}
+
+	var added []string
+	for _, l := range addLabelIDs {
+		if !hasLabel(m, l) {
+			m.labelIDs = append(m.labelIDs, l)
+			added = append(added, l)
+		}
+	}
+	if len(added) > 0 {
+		f.record(&gmail.History{
+			LabelsAdded: []*gmail.HistoryLabelAdded{{Message: f.ref(m), LabelIds: added}},
+		})
+	}
+	return nil
+}
+
+func (f *fakeGmail) ListHistory(userID string, startHistoryID uint64, labelID, pageToken string) (*gmail.ListHistoryResponse, error) {
+	f.count("history.list")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if startHistoryID < f.minHistoryID {
+		return nil, notFound("history")
+	}
+
+	resp := &gmail.ListHistoryResponse{HistoryId: f.historyID}
+	for _, h := range f.history {
+		if h.Id <= startHistoryID {
+			continue
+		}
+
+		involved := false
+		for _, a := range h.MessagesAdded {
+			involved = involved || hasLabel(f.messages[a.Message.Id], labelID)
+		}
+		for _, a := range h.LabelsAdded {
+			involved = involved || hasLabel(f.messages[a.Message.Id], labelID) || containsString(a.LabelIds, labelID)
+		}
+		for _, r := range h.LabelsRemoved {
+			involved = involved || hasLabel(f.messages[r.Message.Id], labelID) || containsString(r.LabelIds, labelID)
+		}
+		if involved {
+			resp.History = append(resp.History, h)
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeGmail) GetProfile(userID string) (*gmail.Profile, error) {
+	f.count("getProfile")
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	return &gmail.Profile{EmailAddress: "me@example.com", HistoryId: f.historyID}, nil
+}
+
+func parseFakeMessage(raw []byte) (mail.Header, []byte) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return mail.Header{}, raw
+	}
+	body, _ := io.ReadAll(m.Body)
+	return m.Header, body
+}
+
+func decodeFakeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func decodeFakeCTE(cte string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.ReplaceAll(body, []byte("\r\n"), nil))))
+		if err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return decoded
+		}
+	}
+	return body
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxFilenameLen is the max length in bytes of a file name made of a subject, without its extension.
+// It leaves room for extensions and conflict suffixes within 255, the limit of most filesystems.
+const maxFilenameLen = 200
+
+// subjectToFilename maps subject to a file name (without extension) safe on Windows and FAT.
+//
+// Characters not allowed there, path separators, leading dots and '%' itself are escaped
+// as %XX of their UTF-8 bytes, so that filenameToSubject recovers the subject.
+// extra is the number of leading characters to be escaped additionally, which gives
+// another name of the same subject to avoid collisions.
+// Names longer than maxFilenameLen are truncated, and are not reversible.
+func subjectToFilename(subject string, extra int) string {
+	runes := []rune(subject)
+
+	build := func(extra int) string {
+		var sb strings.Builder
+		for i, r := range runes {
+			if i < extra || needsEscape(r, i, len(runes)) {
+				for _, b := range []byte(string(r)) {
+					fmt.Fprintf(&sb, "%%%02X", b)
+				}
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+		return sb.String()
+	}
+
+	name := build(extra)
+	if isReservedFilename(name) && extra < 1 {
+		name = build(1)
+	}
+
+	if len(name) > maxFilenameLen {
+		n := maxFilenameLen
+		// not in the middle of a character or %XX
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		if i := strings.LastIndexByte(name[:n], '%'); i >= 0 && n-i < 3 {
+			n = i
+		}
+		name = strings.TrimRight(name[:n], ". ")
+	}
+	return name
+}
+
+func needsEscape(r rune, i, n int) bool {
+	switch {
+	case r < 0x20 || r == 0x7f:
+		return true
+	case strings.ContainsRune(`\/:*?"<>|%`, r):
+		return true
+	case i == 0 && (r == '.' || r == ' '):
+		// hidden files, "..", or trimmed by Windows
+		return true
+	case i == n-1 && (r == '.' || r == ' '):
+		// trimmed by Windows
+		return true
+	}
+	return false
+}
+
+// isReservedFilename reports whether name is a device name of Windows, like CON or com1.txt.
+func isReservedFilename(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	switch strings.ToUpper(strings.TrimRight(name, " ")) {
+	case "CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9":
+		return true
+	}
+	return false
+}
+
+// filenameToSubject reverses subjectToFilename.
+// name is without extension.
+func filenameToSubject(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+3 <= len(name) {
+			if v, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(v))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, name[i])
+	}
+	return string(b)
+}
+
+// subjectOfPath returns the subject of a file, reversing subjectToFilename.
+func subjectOfPath(path string) string {
+	base := filepath.Base(path)
+	return filenameToSubject(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// nameTable tracks file names (paths) taken by subjects.
+// Names are compared case-insensitively, as FAT does.
+type nameTable map[string]string
+
+func (t nameTable) take(name, subject string) {
+	t[nameKey(name)] = subject
+}
+
+// usedByOther reports whether name is taken by a subject other than subject.
+func (t nameTable) usedByOther(name, subject string) bool {
+	s, found := t[nameKey(name)]
+	return found && s != subject
+}
+
+func nameKey(name string) string {
+	return strings.ToLower(filepath.ToSlash(filepath.Clean(name)))
+}
+
+// filename returns a file name for subject, made by format ({subject} in it is replaced),
+// which is not taken by other subjects in t.
+// The name is taken by subject.
+func (t nameTable) filename(format, subject string) string {
+	build := func(base string) string {
+		return strings.ReplaceAll(format, "{subject}", base)
+	}
+
+	name := ""
+	for extra := 0; extra <= utf8.RuneCountInString(subject); extra++ {
+		name = build(subjectToFilename(subject, extra))
+		if !t.usedByOther(name, subject) {
+			t.take(name, subject)
+			return name
+		}
+	}
+
+	// truncated names may still collide
+	for i := 2; ; i++ {
+		name = build(subjectToFilename(subject, 0) + "~" + strconv.Itoa(i))
+		if !t.usedByOther(name, subject) {
+			t.take(name, subject)
+			return name
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubjectToFilename(t *testing.T) {
+	tests := []struct {
+		subject string
+		extra   int
+		want    string
+	}{
+		{subject: "memo", want: "memo"},
+		{subject: "日記 2023", want: "日記 2023"},
+		{subject: "a/b", want: "a%2Fb"},
+		{subject: `c:\x`, want: "c%3A%5Cx"},
+		{subject: "what?*", want: "what%3F%2A"},
+		{subject: `"<|>"`, want: "%22%3C%7C%3E%22"},
+		{subject: "100%", want: "100%25"},
+		{subject: "..", want: "%2E%2E"},
+		{subject: ".hidden", want: "%2Ehidden"},
+		{subject: "trailing. ", want: "trailing.%20"},
+		{subject: "tab\there", want: "tab%09here"},
+		{subject: "CON", want: "%43ON"},
+		{subject: "com1.txt", want: "%63om1.txt"},
+		{subject: "console", want: "console"},
+		{subject: "memo", extra: 1, want: "%6Demo"},
+		{subject: "日記", extra: 1, want: "%E6%97%A5記"},
+	}
+	for _, tt := range tests {
+		got := subjectToFilename(tt.subject, tt.extra)
+		if got != tt.want {
+			t.Errorf("subjectToFilename(%q, %d): got %q, want %q", tt.subject, tt.extra, got, tt.want)
+		}
+		if back := filenameToSubject(got); back != tt.subject {
+			t.Errorf("filenameToSubject(%q): got %q, want %q", got, back, tt.subject)
+		}
+	}
+}
+
+func TestSubjectToFilenameTruncates(t *testing.T) {
+	for _, subject := range []string{
+		strings.Repeat("a", 300),
+		strings.Repeat("日", 100),
+		strings.Repeat("/", 100),
+		strings.Repeat("a", 199) + "/",
+	} {
+		got := subjectToFilename(subject, 0)
+		if len(got) > maxFilenameLen {
+			t.Errorf("%q: too long %v", got, len(got))
+		}
+		if !strings.HasPrefix(subject, filenameToSubject(got)) {
+			t.Errorf("%q: broken %q", subject, got)
+		}
+	}
+}
+
+func TestFilenameToSubjectKeepsStrayPercents(t *testing.T) {
+	for _, name := range []string{"50%OFF", "%", "a%4"} {
+		if got := filenameToSubject(name); got != name {
+			t.Errorf("got %q, want %q", got, name)
+		}
+	}
+}
+
+func TestNameTable(t *testing.T) {
+	names := make(nameTable)
+	var got []string
+	for _, subject := range []string{"memo", "Memo", "MEMO", "memo", "a/b"} {
+		got = append(got, names.filename("{subject}.txt", subject))
+	}
+	want := []string{"memo.txt", "%4Demo.txt", "%4D%45MO.txt", "memo.txt", "a%2Fb.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	long := strings.Repeat("x", 300)
+	a := names.filename("{subject}.txt", long)
+	b := names.filename("{subject}.txt", long+"y")
+	if a == b {
+		t.Errorf("truncated names collide: %v", a)
+	}
+}
+
+func TestGetPutSafeFilenames(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "a/b", "slash", time.Now())
+	f.addNote(testLabel, "../escape", "dots", time.Now())
+	f.addNote(testLabel, "Memo", "upper", time.Now())
+	f.addNote(testLabel, "memo", "lower", time.Now().Add(-time.Hour))
+	g := useFakeGmail(t, f)
+
+	captureStdout(t, func() error {
+		return getCmd{OutputTarget: "file", OutputFormat: "{subject}.txt", OutputDest: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, nil)
+	})
+
+	entries, _ := os.ReadDir(dir)
+	var files []string
+	for _, e := range entries {
+		if e.Name() != stateFileName {
+			files = append(files, e.Name())
+		}
+	}
+	sort.Strings(files)
+	want := []string{"%2E.%2Fescape.txt", "%6Demo.txt", "Memo.txt", "a%2Fb.txt"}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v, want %v", files, want)
+	}
+
+	// put recovers the subjects by the state
+	for _, name := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte("edited"), 0644)
+	}
+	captureStdout(t, func() error {
+		return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"*.txt"})
+	})
+	got := f.notes(testLabel)
+	wantNotes := map[string]string{"a/b": "edited", "../escape": "edited", "Memo": "edited", "memo": "edited"}
+	if !reflect.DeepEqual(got, wantNotes) {
+		t.Errorf("got %v, want %v", got, wantNotes)
+	}
+
+	// or by the file names
+	dir = t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a%2Fb.txt"), []byte("again"), 0644)
+	os.WriteFile(filepath.Join(dir, "100%25.txt"), []byte("new"), 0644)
+	captureStdout(t, func() error {
+		return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"*.txt"})
+	})
+	got = f.notes(testLabel)
+	if got["a/b"] != "again" || got["100%"] != "new" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestPlanSyncAvoidsCaseCollisions(t *testing.T) {
+	state := &syncState{}
+	locals := map[string][]byte{"Memo.txt": []byte("local")}
+	remotes := map[string]*note{"1": {ID: "1", Subject: "memo", Body: []byte("remote")}}
+
+	var got []string
+	for _, a := range planSync(state, locals, remotes) {
+		got = append(got, a.Op+" "+a.Path+" "+a.Subject)
+	}
+	want := []string{syncDownload + " %6Demo.txt memo", syncUpload + " Memo.txt Memo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
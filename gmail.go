@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// gmailStore is a NoteStore backed by Gmail.
+type gmailStore struct {
+	api    gmailAPI
+	userID string
+	label  *gmail.Label
+	cache  *messageCache
+
+	keepHistory  bool
+	historyLabel *gmail.Label // found or created on demand
+
+	unreadable []string // IDs of messages skipped by getNotes
+}
+
+var _ NoteStore = (*gmailStore)(nil)
+
+// openNoteStore connects to the label of g.
+func openNoteStore(g globalCmd) (NoteStore, error) {
+	api, err := newGmailAPI(g)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := loadMessageCache(g.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &gmailStore{
+		api:    api,
+		userID: g.UserID,
+		cache:  cache,
+
+		keepHistory: g.KeepHistory,
+	}
+
+	s.label, err = s.findLabel(g.Label)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// gmailAPI is the part of Gmail API that gmailStore uses.
+type gmailAPI interface {
+	ListLabels(userID string) ([]*gmail.Label, error)
+	CreateLabel(userID string, l *gmail.Label) (*gmail.Label, error)
+	ListMessages(userID, labelID, q, pageToken string) (*gmail.ListMessagesResponse, error)
+	GetMessage(userID, id, format string) (*gmail.Message, error)
+	InsertMessage(userID string, m *gmail.Message) (*gmail.Message, error)
+	TrashMessage(userID, id string) error
+	UntrashMessage(userID, id string) error
+	ModifyMessage(userID, id string, addLabelIDs, removeLabelIDs []string) error
+	ListHistory(userID string, startHistoryID uint64, labelID, pageToken string) (*gmail.ListHistoryResponse, error)
+	GetProfile(userID string) (*gmail.Profile, error)
+}
+
+// endpointEnv is the environment variable of a Gmail API endpoint used without authentication,
+// for testing against a local stand-in server.
+const endpointEnv = "PMSYNC_GMAIL_ENDPOINT"
+
+// newGmailAPI connects to Gmail.
+// Tests replace it with a fake.
+var newGmailAPI = func(g globalCmd) (gmailAPI, error) {
+	ctx := context.Background()
+
+	if endpoint := os.Getenv(endpointEnv); endpoint != "" {
+		gmailService, err := gmail.NewService(ctx, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+		if err != nil {
+			return nil, xerrors.Errorf("failed to instantiate a gmail service: %v", err)
+		}
+		return serviceAPI{gmailService}, nil
+	}
+
+	config, err := getConfig(g.Credentials, g.ClientID, g.ClientSecret)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get config: %v", err)
+	}
+
+	/*client*/
+	_, token, err := getClient(config, g.Token, g.AuthPort)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect services: %v", err)
+	}
+
+	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(newSavingTokenSource(ctx, config, token, g.Token)))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to instantiate a gmail service: %v", err)
+	}
+
+	return serviceAPI{gmailService}, nil
+}
+
+// serviceAPI is gmailAPI of the real Gmail.
+//
+// Calls are retried on rate limits and server errors.
+type serviceAPI struct {
+	service *gmail.Service
+}
+
+func (a serviceAPI) ListLabels(userID string) (labels []*gmail.Label, err error) {
+	err = retry(true, func() error {
+		resp, err := gmail.NewUsersLabelsService(a.service).List(userID).Do()
+		if err != nil {
+			return err
+		}
+		labels = resp.Labels
+		return nil
+	})
+	return labels, err
+}
+
+func (a serviceAPI) CreateLabel(userID string, l *gmail.Label) (created *gmail.Label, err error) {
+	// a server error may leave the label created, so only rejected requests are retried
+	err = retry(false, func() (err error) {
+		created, err = gmail.NewUsersLabelsService(a.service).Create(userID, l).Do()
+		return err
+	})
+	return created, err
+}
+
+func (a serviceAPI) ListMessages(userID, labelID, q, pageToken string) (resp *gmail.ListMessagesResponse, err error) {
+	call := gmail.NewUsersMessagesService(a.service).List(userID).LabelIds(labelID).Q(q).MaxResults(500)
+	if pageToken != "" {
+		call.PageToken(pageToken)
+	}
+	err = retry(true, func() (err error) {
+		resp, err = call.Do()
+		return err
+	})
+	return resp, err
+}
+
+func (a serviceAPI) GetMessage(userID, id, format string) (m *gmail.Message, err error) {
+	err = retry(true, func() (err error) {
+		m, err = gmail.NewUsersMessagesService(a.service).Get(userID, id).Format(format).Do()
+		return err
+	})
+	return m, err
+}
+
+func (a serviceAPI) InsertMessage(userID string, m *gmail.Message) (inserted *gmail.Message, err error) {
+	// a server error may leave the message inserted, so only rejected requests are retried
+	err = retry(false, func() (err error) {
+		inserted, err = gmail.NewUsersMessagesService(a.service).Insert(userID, m).Do()
+		return err
+	})
+	return inserted, err
+}
+
+func (a serviceAPI) TrashMessage(userID, id string) error {
+	return retry(true, func() error {
+		_, err := gmail.NewUsersMessagesService(a.service).Trash(userID, id).Do()
+		return err
+	})
+}
+
+func (a serviceAPI) UntrashMessage(userID, id string) error {
+	return retry(true, func() error {
+		_, err := gmail.NewUsersMessagesService(a.service).Untrash(userID, id).Do()
+		return err
+	})
+}
+
+func (a serviceAPI) ModifyMessage(userID, id string, addLabelIDs, removeLabelIDs []string) error {
+	req := &gmail.ModifyMessageRequest{
+		AddLabelIds:    addLabelIDs,
+		RemoveLabelIds: removeLabelIDs,
+	}
+	return retry(true, func() error {
+		_, err := gmail.NewUsersMessagesService(a.service).Modify(userID, id, req).Do()
+		return err
+	})
+}
+
+func (a serviceAPI) ListHistory(userID string, startHistoryID uint64, labelID, pageToken string) (resp *gmail.ListHistoryResponse, err error) {
+	call := gmail.NewUsersHistoryService(a.service).List(userID).
+		StartHistoryId(startHistoryID).
+		LabelId(labelID).
+		HistoryTypes("messageAdded", "messageDeleted", "labelAdded", "labelRemoved")
+	if pageToken != "" {
+		call.PageToken(pageToken)
+	}
+	err = retry(true, func() (err error) {
+		resp, err = call.Do()
+		return err
+	})
+	return resp, err
+}
+
+func (a serviceAPI) GetProfile(userID string) (p *gmail.Profile, err error) {
+	err = retry(true, func() (err error) {
+		p, err = gmail.NewUsersService(a.service).GetProfile(userID).Do()
+		return err
+	})
+	return p, err
+}
+
+// retryWait is the wait before the first retry, doubled for each retry.
+var retryWait = time.Second
+
+const maxRetries = 5
+
+// retry calls fn again while it fails with a rate limit,
+// or a server error if the call is idempotent.
+// Retry-After is honored if returned.
+func retry(idempotent bool, fn func() error) error {
+	wait := retryWait
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i == maxRetries {
+			return err
+		}
+
+		var gerr *googleapi.Error
+		if !xerrors.As(err, &gerr) {
+			return err
+		}
+		switch {
+		case isRateLimited(gerr):
+		case idempotent && gerr.Code >= 500:
+		default:
+			return err
+		}
+
+		d := wait
+		if sec, err := strconv.Atoi(gerr.Header.Get("Retry-After")); err == nil && sec > 0 {
+			d = time.Duration(sec) * time.Second
+		}
+		time.Sleep(d)
+		wait *= 2
+	}
+}
+
+func isRateLimited(gerr *googleapi.Error) bool {
+	if gerr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if gerr.Code == http.StatusForbidden {
+		for _, e := range gerr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *gmailStore) findLabel(name string) (*gmail.Label, error) {
+	labels, err := s.api.ListLabels(s.userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, lbl := range labels {
+		if lbl.Name == name {
+			return lbl, nil
+		}
+	}
+	return nil, fmt.Errorf("Label %q not found", name)
+}
+
+func (s *gmailStore) Labels() ([]string, error) {
+	labels, err := s.api.ListLabels(s.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(labels))
+	for _, lbl := range labels {
+		names = append(names, lbl.Name)
+	}
+	return names, nil
+}
+
+func (s *gmailStore) List(q string, max int) ([]*note, int, error) {
+	var ids []string
+	var err error
+	if q == "" {
+		ids, err = s.labelMessageIDs()
+	} else {
+		ids, err = s.listMessageIDs(s.label.Id, q)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(ids)
+	if max > 0 && len(ids) > max {
+		ids = ids[:max]
+	}
+
+	return s.getNotes(ids), total, nil
+}
+
+// listMessageIDs returns IDs of messages under labelID matching q, walking all pages.
+func (s *gmailStore) listMessageIDs(labelID, q string) ([]string, error) {
+	var ids []string
+
+	pageToken := ""
+	for {
+		resp, err := s.api.ListMessages(s.userID, labelID, q, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range resp.Messages {
+			ids = append(ids, msg.Id)
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	return ids, nil
+}
+
+// getNotes returns notes in the order of ids.
+// A message failed to be got or decoded is reported and skipped, not to block the others.
+func (s *gmailStore) getNotes(ids []string) []*note {
+	notes := make([]*note, len(ids))
+	errs := make([]error, len(ids))
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, 8)
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			notes[i], errs[i] = s.Get(id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	read := notes[:0]
+	for i, n := range notes {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: message %v skipped: %v\n", ids[i], errs[i])
+			s.unreadable = append(s.unreadable, ids[i])
+			continue
+		}
+		read = append(read, n)
+	}
+	return read
+}
+
+func (s *gmailStore) Unreadable() []string {
+	return s.unreadable
+}
+
+func (s *gmailStore) Get(id string) (*note, error) {
+	m, err := s.getMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNote(m)
+}
+
+func (s *gmailStore) Create(uuid, subject string, body []byte) (*note, error) {
+	if uuid == "" {
+		uuid = newNoteUUID()
+	}
+
+	m, err := s.api.InsertMessage(s.userID, newNoteMessage(s.userID, s.label.Id, uuid, subject, body))
+	if err != nil {
+		return nil, err
+	}
+
+	return &note{
+		ID:      m.Id,
+		UUID:    uuid,
+		Subject: subject,
+		Date:    time.Now(),
+		Body:    body,
+	}, nil
+}
+
+func (s *gmailStore) Update(id, subject string, body []byte) (*note, error) {
+	// the new one inherits the UUID to be the same note
+	uuid := ""
+	if old, err := s.Get(id); err == nil {
+		uuid = old.UUID
+	}
+
+	// Gmail messages are immutable, so the old one is replaced
+	retire := s.Trash
+	if s.keepHistory {
+		retire = s.Archive
+	}
+	if err := retire(id); err != nil {
+		return nil, err
+	}
+	return s.Create(uuid, subject, body)
+}
+
+func (s *gmailStore) Trash(id string) error {
+	return s.api.TrashMessage(s.userID, id)
+}
+
+func (s *gmailStore) Restore(id string) error {
+	return s.api.UntrashMessage(s.userID, id)
+}
+
+func (s *gmailStore) Archive(id string) error {
+	history, err := s.findHistoryLabel(true)
+	if err != nil {
+		return err
+	}
+	return s.api.ModifyMessage(s.userID, id, []string{history.Id}, []string{s.label.Id})
+}
+
+func (s *gmailStore) Versions(uuid, subject string) ([]*note, error) {
+	history, err := s.findHistoryLabel(false)
+	if err != nil || history == nil {
+		return nil, err
+	}
+
+	// a UUID follows renames, so all versions are looked into
+	q := ""
+	if uuid == "" {
+		q = subjectQuery(subject)
+	}
+	ids, err := s.listMessageIDs(history.Id, q)
+	if err != nil {
+		return nil, err
+	}
+	notes := s.getNotes(ids)
+
+	versions := notes[:0]
+	for _, n := range notes {
+		if (uuid != "" && n.UUID == uuid) || (uuid == "" && n.Subject == subject) {
+			versions = append(versions, n)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Date.After(versions[j].Date)
+	})
+	return versions, nil
+}
+
+// findHistoryLabel returns the label of old versions, which is under the label of notes.
+// If the label does not exist, it is created if create, or nil is returned.
+func (s *gmailStore) findHistoryLabel(create bool) (*gmail.Label, error) {
+	if s.historyLabel != nil {
+		return s.historyLabel, nil
+	}
+
+	name := s.label.Name + "/history"
+	labels, err := s.api.ListLabels(s.userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, lbl := range labels {
+		if lbl.Name == name {
+			s.historyLabel = lbl
+			return lbl, nil
+		}
+	}
+	if !create {
+		return nil, nil
+	}
+
+	s.historyLabel, err = s.api.CreateLabel(s.userID, &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("create label %q: %v", name, err)
+	}
+	return s.historyLabel, nil
+}
+
+// subjectQuery returns a query of Gmail search narrowing messages down to subject.
+// Gmail search matches words, so the results are to be filtered by the exact subject.
+func subjectQuery(subject string) string {
+	phrase := strings.Join(strings.Fields(strings.NewReplacer(`"`, " ", `\`, " ").Replace(subject)), " ")
+	if phrase == "" {
+		return ""
+	}
+	return `subject:"` + phrase + `"`
+}
+
+func (s *gmailStore) Close() error {
+	return s.cache.save()
+}
+
+func decodeNote(m *gmail.Message) (*note, error) {
+	body, htm, err := noteBody(m.Payload)
+	if err != nil {
+		return nil, xerrors.Errorf("message %v: %v", m.Id, err)
+	}
+
+	header := make(mail.Header)
+	for _, h := range m.Payload.Headers {
+		key := textproto.CanonicalMIMEHeaderKey(h.Name)
+		header[key] = append(header[key], h.Value)
+	}
+
+	dt, err := mail.ParseDate(header.Get("Date"))
+	if err != nil {
+		dt = time.UnixMilli(m.InternalDate)
+	}
+
+	return &note{
+		ID:      m.Id,
+		UUID:    header.Get(uuidHeader),
+		Subject: decodeHeader(header.Get("Subject")),
+		Date:    dt,
+		Snippet: m.Snippet,
+		Body:    body,
+		HTML:    htm,
+		Header:  header,
+	}, nil
+}
+
+// uuidHeader identifies a note across updates, as Apple Notes does.
+const uuidHeader = "X-Universally-Unique-Identifier"
+
+func newNoteUUID() string {
+	return strings.ToUpper(uuid.NewString())
+}
+
+// newNoteMessage builds a message that is recognized as a note by Pomera and iOS Notes.
+func newNoteMessage(userID, labelID, uuid, subject string, content []byte) *gmail.Message {
+	return &gmail.Message{
+		LabelIds: []string{labelID},
+		Raw: base64.URLEncoding.EncodeToString([]byte("Content-Type: text/plain; charset=\"utf-8-sig\"\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"X-Uniform-Type-Identifier: com.apple.mail-note\r\n" +
+			uuidHeader + ": " + uuid + "\r\n" +
+			"From: " + userID + "\r\n" +
+			encodeHeader("Subject", subject) +
+			"Date: " + time.Now().Format(time.RFC822Z) + "\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString(content))),
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// gmailServer is a stand-in for the Gmail REST API, backed by a fakeGmail.
+type gmailServer struct {
+	*httptest.Server
+	f *fakeGmail
+
+	mut sync.Mutex
+	// failures are status codes returned instead of the next responses of a method
+	failures map[string][]int
+	requests map[string]int
+}
+
+func newGmailServer(t *testing.T, f *fakeGmail) *gmailServer {
+	t.Helper()
+
+	s := &gmailServer{
+		f:        f,
+		failures: make(map[string][]int),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	t.Setenv(endpointEnv, s.URL+"/")
+
+	orig := retryWait
+	retryWait = time.Millisecond
+	t.Cleanup(func() {
+		retryWait = orig
+	})
+
+	return s
+}
+
+// fail makes the next responses of method (like "messages.list") fail with codes.
+func (s *gmailServer) fail(method string, codes ...int) {
+	s.mut.Lock()
+	s.failures[method] = append(s.failures[method], codes...)
+	s.mut.Unlock()
+}
+
+// global returns global options to run commands against s.
+func (s *gmailServer) global() globalCmd {
+	return globalCmd{
+		UserID: "me",
+		Label:  testLabel,
+	}
+}
+
+func (s *gmailServer) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/")
+	if path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	elems := strings.Split(path, "/")
+	userID, elems := elems[0], elems[1:]
+	q := r.URL.Query()
+
+	var method string
+	var handle func() (interface{}, error)
+
+	switch {
+	case r.Method == http.MethodGet && len(elems) == 1 && elems[0] == "profile":
+		method = "getProfile"
+		handle = func() (interface{}, error) {
+			return s.f.GetProfile(userID)
+		}
+
+	case r.Method == http.MethodGet && len(elems) == 1 && elems[0] == "labels":
+		method = "labels.list"
+		handle = func() (interface{}, error) {
+			labels, err := s.f.ListLabels(userID)
+			return &gmail.ListLabelsResponse{Labels: labels}, err
+		}
+
+	case r.Method == http.MethodPost && len(elems) == 1 && elems[0] == "labels":
+		method = "labels.create"
+		handle = func() (interface{}, error) {
+			var l gmail.Label
+			if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+				return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+			}
+			return s.f.CreateLabel(userID, &l)
+		}
+
+	case r.Method == http.MethodGet && len(elems) == 1 && elems[0] == "messages":
+		method = "messages.list"
+		handle = func() (interface{}, error) {
+			return s.f.ListMessages(userID, q.Get("labelIds"), q.Get("q"), q.Get("pageToken"))
+		}
+
+	case r.Method == http.MethodPost && len(elems) == 1 && elems[0] == "messages":
+		method = "messages.insert"
+		handle = func() (interface{}, error) {
+			var m gmail.Message
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+			}
+			return s.f.InsertMessage(userID, &m)
+		}
+
+	case r.Method == http.MethodGet && len(elems) == 2 && elems[0] == "messages":
+		method = "messages.get"
+		handle = func() (interface{}, error) {
+			return s.f.GetMessage(userID, elems[1], q.Get("format"))
+		}
+
+	case r.Method == http.MethodPost && len(elems) == 3 && elems[0] == "messages" && elems[2] == "trash":
+		method = "messages.trash"
+		handle = func() (interface{}, error) {
+			return &gmail.Message{Id: elems[1]}, s.f.TrashMessage(userID, elems[1])
+		}
+
+	case r.Method == http.MethodPost && len(elems) == 3 && elems[0] == "messages" && elems[2] == "untrash":
+		method = "messages.untrash"
+		handle = func() (interface{}, error) {
+			return &gmail.Message{Id: elems[1]}, s.f.UntrashMessage(userID, elems[1])
+		}
+
+	case r.Method == http.MethodPost && len(elems) == 3 && elems[0] == "messages" && elems[2] == "modify":
+		method = "messages.modify"
+		handle = func() (interface{}, error) {
+			var req gmail.ModifyMessageRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+			}
+			return &gmail.Message{Id: elems[1]}, s.f.ModifyMessage(userID, elems[1], req.AddLabelIds, req.RemoveLabelIds)
+		}
+
+	case r.Method == http.MethodGet && len(elems) == 1 && elems[0] == "history":
+		method = "history.list"
+		handle = func() (interface{}, error) {
+			start, err := strconv.ParseUint(q.Get("startHistoryId"), 10, 64)
+			if err != nil {
+				return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid startHistoryId"}
+			}
+			return s.f.ListHistory(userID, start, q.Get("labelId"), q.Get("pageToken"))
+		}
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mut.Lock()
+	s.requests[method]++
+	var code int
+	if codes := s.failures[method]; len(codes) > 0 {
+		code, s.failures[method] = codes[0], codes[1:]
+	}
+	s.mut.Unlock()
+
+	if code != 0 {
+		writeGmailError(w, &googleapi.Error{Code: code, Message: http.StatusText(code)})
+		return
+	}
+
+	resp, err := handle()
+	if err != nil {
+		var gerr *googleapi.Error
+		if !xerrors.As(err, &gerr) {
+			gerr = &googleapi.Error{Code: http.StatusInternalServerError, Message: err.Error()}
+		}
+		writeGmailError(w, gerr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeGmailError(w http.ResponseWriter, gerr *googleapi.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(gerr.Code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, gerr.Code, gerr.Message)
+}
+
+func TestEndpointListPaging(t *testing.T) {
+	f := newFakeGmail(testLabel, "other")
+	f.pageSize = 3
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		f.addNote(testLabel, fmt.Sprintf("note%02d", i), "body", base.Add(time.Duration(i)*time.Hour))
+	}
+	f.addNote("other", "not a note", "body", base)
+	s := newGmailServer(t, f)
+
+	out := captureStdout(t, func() error {
+		return listCmd{Format: "{subject}", Sort: []string{"subject"}}.Run(s.global(), nil)
+	})
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("note%02d", i))
+	}
+	if got := strings.Fields(out); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := s.requests["messages.list"]; got != 4 {
+		t.Errorf("messages.list: got %v requests, want 4", got)
+	}
+}
+
+func TestEndpointRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		failures []int
+
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "rate limit",
+			method:       "messages.list",
+			failures:     []int{http.StatusTooManyRequests, http.StatusTooManyRequests},
+			wantRequests: 3,
+		},
+		{
+			name:         "server error",
+			method:       "messages.get",
+			failures:     []int{http.StatusServiceUnavailable},
+			wantRequests: 2,
+		},
+		{
+			name:         "give up",
+			method:       "labels.list",
+			failures:     []int{500, 500, 500, 500, 500, 500, 500},
+			wantErr:      true,
+			wantRequests: maxRetries + 1,
+		},
+		{
+			name:         "client error",
+			method:       "messages.list",
+			failures:     []int{http.StatusBadRequest},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGmail(testLabel)
+			f.addNote(testLabel, "memo", "hello", time.Now())
+			s := newGmailServer(t, f)
+			s.fail(tt.method, tt.failures...)
+
+			err := listCmd{Format: "{subject}"}.Run(s.global(), nil)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("err: %v", err)
+			}
+			if got := s.requests[tt.method]; got != tt.wantRequests {
+				t.Errorf("%v: got %v requests, want %v", tt.method, got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestEndpointInsertIsNotRetriedOnServerError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "memo.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeGmail(testLabel)
+	s := newGmailServer(t, f)
+	s.fail("messages.insert", http.StatusInternalServerError)
+
+	cmd := putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}
+	if err := cmd.Run(s.global(), []string{"memo.txt"}); err == nil {
+		t.Error("error expected")
+	}
+	if got := s.requests["messages.insert"]; got != 1 {
+		t.Errorf("got %v requests", got)
+	}
+
+	s.fail("messages.insert", http.StatusTooManyRequests)
+	if err := cmd.Run(s.global(), []string{"memo.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.notes(testLabel); got["memo"] != "hello" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestEndpointHistory(t *testing.T) {
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "first", "1", time.Now().Add(-time.Hour))
+	s := newGmailServer(t, f)
+
+	g := s.global()
+	g.Cache = filepath.Join(t.TempDir(), "cache.json")
+	list := func() string {
+		return strings.Join(strings.Fields(captureStdout(t, func() error {
+			return listCmd{Format: "{subject}", Sort: []string{"subject"}}.Run(g, nil)
+		})), " ")
+	}
+
+	if got := list(); got != "first" {
+		t.Errorf("got %q", got)
+	}
+	if got := s.requests["history.list"]; got != 0 {
+		t.Errorf("history.list: got %v requests", got)
+	}
+
+	f.addNote(testLabel, "second", "2", time.Now())
+	if got := list(); got != "first second" {
+		t.Errorf("got %q", got)
+	}
+	if got := s.requests["messages.list"]; got != 1 {
+		t.Errorf("messages.list: got %v requests, want only the first run", got)
+	}
+	if got := s.requests["messages.get"]; got != 2 {
+		t.Errorf("messages.get: got %v requests, want 2 (cached)", got)
+	}
+
+	// too old history ID results in listing all
+	f.expireHistory()
+	if got := list(); got != "first second" {
+		t.Errorf("got %q", got)
+	}
+	if got := s.requests["messages.list"]; got != 2 {
+		t.Errorf("messages.list: got %v requests", got)
+	}
+}
+
+func TestEndpointKeepHistory(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	s := newGmailServer(t, f)
+
+	g := s.global()
+	g.Cache = filepath.Join(t.TempDir(), "cache.json")
+	g.KeepHistory = true
+	list := func() string {
+		return strings.Join(strings.Fields(captureStdout(t, func() error {
+			return listCmd{Format: "{subject}:{body}"}.Run(g, nil)
+		})), " ")
+	}
+
+	for _, v := range []string{"v1", "v2"} {
+		os.WriteFile(filepath.Join(dir, "memo.txt"), []byte(v), 0644)
+		if err := (putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}).Run(g, []string{"memo.txt"}); err != nil {
+			t.Fatal(err)
+		}
+		// the cache follows the replaced one leaving the label
+		if got, want := list(), "memo:"+v; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if got := s.requests["labels.create"]; got != 1 {
+		t.Errorf("labels.create: got %v requests", got)
+	}
+	if got := f.notes(testLabel + "/history"); got["memo"] != "v1" {
+		t.Errorf("history: got %v", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset known to browsers (ISO-2022-JP, Shift_JIS, ...).
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// decodeHeader decodes encoded words in a header value.
+// The value is returned as it is if it cannot be decoded.
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// maxHeaderLine is the length of header lines to be folded at, as RFC 5322 recommends.
+const maxHeaderLine = 78
+
+// encodeHeader returns a header field "name: value\r\n",
+// encoding value in UTF-8 encoded words if needed, and folding long lines.
+func encodeHeader(name, value string) string {
+	var sb strings.Builder
+	sb.WriteString(name + ":")
+	lineLen := len(name) + 1
+
+	// ASCII looking like encoded words is encoded not to be decoded
+	if mime.BEncoding.Encode("UTF-8", value) == value && !strings.Contains(value, "=?") {
+		// no need to encode, fold at spaces
+		for i, word := range strings.Split(value, " ") {
+			if i > 0 && lineLen+1+len(word) > maxHeaderLine {
+				sb.WriteString("\r\n")
+				lineLen = 0
+			}
+			sb.WriteString(" " + word)
+			lineLen += 1 + len(word)
+		}
+		sb.WriteString("\r\n")
+		return sb.String()
+	}
+
+	// encoded words fitting in the rest of each line, not splitting characters
+	const prefix, suffix = "=?UTF-8?B?", "?="
+	wordLen := func(n int) int {
+		return len(prefix) + base64.StdEncoding.EncodedLen(n) + len(suffix)
+	}
+	for len(value) > 0 {
+		n := 0
+		for n < len(value) {
+			_, size := utf8.DecodeRuneInString(value[n:])
+			if n > 0 && lineLen+1+wordLen(n+size) > maxHeaderLine {
+				break
+			}
+			n += size
+		}
+		sb.WriteString(" " + prefix + base64.StdEncoding.EncodeToString([]byte(value[:n])) + suffix)
+		value = value[n:]
+
+		if len(value) > 0 {
+			sb.WriteString("\r\n")
+			lineLen = 0
+		}
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
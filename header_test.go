@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain subject", "plain subject"},
+		{"=?UTF-8?B?5pel6KiY?=", "日記"},
+		{"=?utf-8?q?caf=C3=A9_menu?=", "café menu"},
+		{"=?ISO-2022-JP?B?GyRCRnxLXBsoQg==?=", "日本"},
+		{"=?Shift_JIS?B?k/qLTA==?=", "日記"},
+		{"=?UTF-8?B?5pel?= =?UTF-8?B?6KiY?=", "日記"},
+		{"Re: =?UTF-8?B?5pel6KiY?=", "Re: 日記"},
+		{"=?x-unknown?B?5pel6KiY?=", "=?x-unknown?B?5pel6KiY?="},
+	}
+	for _, tt := range tests {
+		if got := decodeHeader(tt.in); got != tt.want {
+			t.Errorf("decodeHeader(%q): got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeHeader(t *testing.T) {
+	tests := []string{
+		"memo",
+		"日記",
+		"a short ascii subject",
+		strings.Repeat("とても長い日本語のタイトル", 10),
+		strings.TrimSpace(strings.Repeat("a long ascii subject ", 10)),
+		"foo =?UTF-8?B?YWJj?= bar",
+		"=?",
+	}
+	for _, subject := range tests {
+		field := encodeHeader("Subject", subject)
+
+		for _, line := range strings.Split(strings.TrimSuffix(field, "\r\n"), "\r\n") {
+			if len(line) > maxHeaderLine {
+				t.Errorf("%q: too long line %q", subject, line)
+			}
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader([]byte(field + "\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeHeader(m.Header.Get("Subject")); got != subject {
+			t.Errorf("round trip: got %q, want %q", got, subject)
+		}
+	}
+}
+
+func TestListCmdDecodesSubject(t *testing.T) {
+	f := newFakeGmail(testLabel)
+	f.addNote(testLabel, "=?ISO-2022-JP?B?GyRCRnxLXBsoQg==?=", "body", time.Now())
+	g := useFakeGmail(t, f)
+
+	out := captureStdout(t, func() error {
+		return listCmd{Format: "{subject}"}.Run(g, nil)
+	})
+	if strings.TrimSpace(out) != "日本" {
+		t.Errorf("got %q", out)
+	}
+}
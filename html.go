@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlToText converts HTML (typically of Apple Notes) into plain text.
+//
+// Lines are broken at <br> and block elements, list items become "- " lines
+// (indented by nesting), and entities are unescaped.
+func htmlToText(b []byte) []byte {
+	var buf bytes.Buffer
+
+	atLineStart := func() bool {
+		return buf.Len() == 0 || buf.Bytes()[buf.Len()-1] == '\n'
+	}
+	breakLine := func() {
+		if !atLineStart() {
+			buf.WriteByte('\n')
+		}
+	}
+
+	z := html.NewTokenizer(bytes.NewReader(b))
+	skip := 0  // inside <head>, <script> or <style>
+	depth := 0 // of lists
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			// EOF, or broken HTML where what is read so far is returned
+			return trimLineSpaces(buf.Bytes())
+
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := collapseSpaces(string(z.Text()))
+			if atLineStart() {
+				text = strings.TrimLeft(text, " ")
+			}
+			// &nbsp;
+			buf.WriteString(strings.ReplaceAll(text, "\u00a0", " "))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "head", "script", "style":
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case "br":
+				buf.WriteByte('\n')
+			case "ul", "ol":
+				breakLine()
+				depth++
+			case "li":
+				breakLine()
+				if depth > 1 {
+					buf.WriteString(strings.Repeat("  ", depth-1))
+				}
+				buf.WriteString("- ")
+			case "p", "div", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre":
+				breakLine()
+			}
+
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "head", "script", "style":
+				if skip > 0 {
+					skip--
+				}
+			case "ul", "ol":
+				breakLine()
+				if depth > 0 {
+					depth--
+				}
+			case "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre":
+				breakLine()
+			}
+		}
+	}
+}
+
+// collapseSpaces replaces runs of white spaces with a space, as browsers do.
+func collapseSpaces(s string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\n', '\r', '\f':
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		sb.WriteRune(r)
+	}
+	if space {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+// trimLineSpaces removes spaces at the end of each line.
+func trimLineSpaces(b []byte) []byte {
+	lines := bytes.Split(b, []byte("\n"))
+	for i, l := range lines {
+		lines[i] = bytes.TrimRight(l, " ")
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "apple notes",
+			html: "<div>first</div>\n<div><br></div>\n<div>third</div>\n",
+			want: "first\n\nthird\n",
+		},
+		{
+			name: "br",
+			html: "a<br>b<br/>c",
+			want: "a\nb\nc",
+		},
+		{
+			name: "entities",
+			html: "<div>&lt;tag&gt; &amp;&nbsp;&nbsp;x &#x65E5;&#35352;</div>",
+			want: "<tag> &  x 日記\n",
+		},
+		{
+			name: "spaces",
+			html: "<p>\n  some\n  words  </p>\n<p>next</p>",
+			want: "some words\nnext\n",
+		},
+		{
+			name: "list",
+			html: "<div>todo</div><ul><li>milk</li><li>eggs<ol><li>brown</li></ol></li></ul><div>end</div>",
+			want: "todo\n- milk\n- eggs\n  - brown\nend\n",
+		},
+		{
+			name: "head and script",
+			html: "<html><head><title>t</title><style>p{}</style></head><body><script>x()</script>body</body></html>",
+			want: "body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(htmlToText([]byte(tt.html))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
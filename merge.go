@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// conflict markers of merge3 (diff3 style)
+const (
+	markerLocal  = "<<<<<<< local"
+	markerBase   = "||||||| base"
+	markerSep    = "======="
+	markerRemote = ">>>>>>> remote"
+)
+
+// merge3 merges changes of local and remote made from base line by line.
+//
+// Hunks changed on both sides are enclosed by diff3-style conflict markers,
+// except lines appended at the end on both sides, which are merged as local then remote.
+// The number of the conflicting hunks is returned.
+func merge3(base, local, remote []byte) ([]byte, int) {
+	o := splitLines(base)
+	a := splitLines(local)
+	b := splitLines(remote)
+
+	matchA := lcsMatch(o, a)
+	matchB := lcsMatch(o, b)
+
+	var merged []string
+	conflicts := 0
+
+	unstable := func(oo, aa, bb []string, atEnd bool) {
+		switch {
+		case equalLines(aa, bb):
+			merged = append(merged, aa...)
+		case equalLines(oo, aa):
+			merged = append(merged, bb...)
+		case equalLines(oo, bb):
+			merged = append(merged, aa...)
+		case len(oo) == 0 && atEnd:
+			merged = append(merged, aa...)
+			merged = append(merged, bb...)
+		default:
+			conflicts++
+			merged = append(merged, markerLocal)
+			merged = append(merged, aa...)
+			merged = append(merged, markerBase)
+			merged = append(merged, oo...)
+			merged = append(merged, markerSep)
+			merged = append(merged, bb...)
+			merged = append(merged, markerRemote)
+		}
+	}
+
+	i, j, k := 0, 0, 0
+	for {
+		// stable lines, unchanged on both sides
+		n := 0
+		for i+n < len(o) && matchA[i+n] == j+n && matchB[i+n] == k+n {
+			n++
+		}
+		if n > 0 {
+			merged = append(merged, o[i:i+n]...)
+			i, j, k = i+n, j+n, k+n
+			continue
+		}
+
+		// next line kept on both sides
+		next := -1
+		for oi := i; oi < len(o); oi++ {
+			if matchA[oi] >= 0 && matchB[oi] >= 0 {
+				next = oi
+				break
+			}
+		}
+		if next < 0 {
+			unstable(o[i:], a[j:], b[k:], true)
+			break
+		}
+
+		unstable(o[i:next], a[j:matchA[next]], b[k:matchB[next]], false)
+		i, j, k = next, matchA[next], matchB[next]
+	}
+
+	eol := "\n"
+	if bytes.Contains(local, []byte("\r\n")) || (len(local) == 0 && bytes.Contains(remote, []byte("\r\n"))) {
+		eol = "\r\n"
+	}
+	result := strings.Join(merged, eol)
+	if len(merged) > 0 && (hasTrailingEOL(local) || hasTrailingEOL(remote)) {
+		result += eol
+	}
+
+	return []byte(result), conflicts
+}
+
+// hasConflictMarkers reports whether content has conflict markers of merge3 left.
+func hasConflictMarkers(content []byte) bool {
+	local, remote := false, false
+	for _, l := range splitLines(content) {
+		switch l {
+		case markerLocal:
+			local = true
+		case markerRemote:
+			remote = true
+		}
+	}
+	return local && remote
+}
+
+// splitLines splits content into lines without line terminators.
+func splitLines(content []byte) []string {
+	s := strings.ReplaceAll(string(content), "\r\n", "\n")
+	if s == "" {
+		return nil
+	}
+	s = strings.TrimSuffix(s, "\n")
+	return strings.Split(s, "\n")
+}
+
+func hasTrailingEOL(content []byte) bool {
+	return bytes.HasSuffix(content, []byte("\n"))
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lcsMatch returns, for each line of a, the index of the matched line of b in their longest common subsequence, or -1.
+func lcsMatch(a, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+
+	// common prefix and suffix, to make the table small
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		match[pre] = pre
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		match[len(a)-1-suf] = len(b) - 1 - suf
+		suf++
+	}
+
+	aa := a[pre : len(a)-suf]
+	bb := b[pre : len(b)-suf]
+	if len(aa) == 0 || len(bb) == 0 {
+		return match
+	}
+
+	// table[i][j] = LCS length of aa[i:] and bb[j:]
+	w := len(bb) + 1
+	table := make([]int32, (len(aa)+1)*w)
+	for i := len(aa) - 1; i >= 0; i-- {
+		for j := len(bb) - 1; j >= 0; j-- {
+			if aa[i] == bb[j] {
+				table[i*w+j] = table[(i+1)*w+j+1] + 1
+			} else if table[(i+1)*w+j] >= table[i*w+j+1] {
+				table[i*w+j] = table[(i+1)*w+j]
+			} else {
+				table[i*w+j] = table[i*w+j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(aa) && j < len(bb) {
+		switch {
+		case aa[i] == bb[j]:
+			match[pre+i] = pre + j
+			i++
+			j++
+		case table[(i+1)*w+j] >= table[i*w+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	return match
+}
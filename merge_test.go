@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+
+		want          string
+		wantConflicts int
+	}{
+		{
+			name:   "append on both sides",
+			base:   "a\nb\n",
+			local:  "a\nb\nlocal\n",
+			remote: "a\nb\nremote\n",
+			want:   "a\nb\nlocal\nremote\n",
+		},
+		{
+			name:          "insertions in the middle",
+			base:          "a\nb\n",
+			local:         "a\nlocal\nb\n",
+			remote:        "a\nremote\nb\n",
+			want:          "a\n" + markerLocal + "\nlocal\n" + markerBase + "\n" + markerSep + "\nremote\n" + markerRemote + "\nb\n",
+			wantConflicts: 1,
+		},
+		{
+			name:   "insertion in the middle and append",
+			base:   "a\nb\n",
+			local:  "a\nlocal\nb\n",
+			remote: "a\nb\nremote\n",
+			want:   "a\nlocal\nb\nremote\n",
+		},
+		{
+			name:   "edits of different lines",
+			base:   "a\nb\nc\n",
+			local:  "A\nb\nc\n",
+			remote: "a\nb\nC\n",
+			want:   "A\nb\nC\n",
+		},
+		{
+			name:   "the same edit",
+			base:   "a\nb\nc\n",
+			local:  "a\nB\nc\n",
+			remote: "a\nB\nc\n",
+			want:   "a\nB\nc\n",
+		},
+		{
+			name:          "edits of the same line",
+			base:          "a\nb\nc\n",
+			local:         "a\nlocal\nc\n",
+			remote:        "a\nremote\nc\n",
+			want:          "a\n" + markerLocal + "\nlocal\n" + markerBase + "\nb\n" + markerSep + "\nremote\n" + markerRemote + "\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name:   "deleted and edited elsewhere",
+			base:   "a\nb\nc\nd\n",
+			local:  "a\nc\nd\n",
+			remote: "a\nb\nc\nD\n",
+			want:   "a\nc\nD\n",
+		},
+		{
+			name:   "CRLF",
+			base:   "a\r\nb\r\n",
+			local:  "a\r\nb\r\nlocal\r\n",
+			remote: "A\nb\n",
+			want:   "A\r\nb\r\nlocal\r\n",
+		},
+		{
+			name:   "CRLF of remote only",
+			base:   "",
+			local:  "",
+			remote: "a\r\nb\r\n",
+			want:   "a\r\nb\r\n",
+		},
+		{
+			name:   "no base",
+			base:   "",
+			local:  "local\n",
+			remote: "remote\n",
+			want:   "local\nremote\n",
+		},
+		{
+			name:   "no base, the same content",
+			base:   "",
+			local:  "a\nb\n",
+			remote: "a\nb\n",
+			want:   "a\nb\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := merge3([]byte(tt.base), []byte(tt.local), []byte(tt.remote))
+			if string(got) != tt.want || conflicts != tt.wantConflicts {
+				t.Errorf("got %q (%d conflicts), want %q (%d conflicts)", got, conflicts, tt.want, tt.wantConflicts)
+			}
+			if hasConflictMarkers(got) != (tt.wantConflicts > 0) {
+				t.Errorf("hasConflictMarkers: got %v", hasConflictMarkers(got))
+			}
+		})
+	}
+}
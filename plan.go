@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// plan operations
+const (
+	planTrash     = "trash"     // a message is sent to the trash
+	planArchive   = "archive"   // a message is moved to the history
+	planInsert    = "insert"    // a message is inserted
+	planCreate    = "create"    // a file is created
+	planOverwrite = "overwrite" // a file is overwritten
+	planDelete    = "delete"    // a file is deleted
+	planMerge     = "merge"     // a note is merged, then uploaded and written
+	planConflict  = "conflict"  // a note is changed on both sides
+)
+
+// planItem is an action that would be taken by --dry-run.
+type planItem struct {
+	Op      string `json:"op"`
+	ID      string `json:"id,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type plan struct {
+	Items []planItem `json:"items"`
+}
+
+func (p *plan) add(item planItem) {
+	p.Items = append(p.Items, item)
+}
+
+// planReplaced returns the operation on a message replaced by an update.
+func planReplaced(g globalCmd) string {
+	if g.KeepHistory {
+		return planArchive
+	}
+	return planTrash
+}
+
+func checkPlanFormat(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown plan format %q", format)
+}
+
+// print writes p in format {text,json}.
+func (p plan) print(w io.Writer, format string) error {
+	if format == "json" {
+		if p.Items == nil {
+			p.Items = []planItem{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, item := range p.Items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", item.Op, item.ID, item.Path, item.Subject, item.Detail)
+	}
+	return tw.Flush()
+}
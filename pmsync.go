@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/browser"
@@ -32,15 +44,28 @@ type globalCmd struct {
 
 	Credentials string `cli:"credentials,c=FILE_NAME"  default:"./credentials.json"  help:"your client configuration file from Google Developer Console"`
 	Token       string `cli:"token,t=FILE_NAME"  default:"./token.json"  help:"file path to read/write retrieved token"`
+	Cache       string `cli:"cache=FILE_NAME"  default:"./pmsync_cache.json"  help:"file path to cache messages and the history ID to fetch only changes (empty to disable)"`
 
 	ClientID, ClientSecret string `help:"if no credentials.json"`
 	AuthPort               uint16 `cli:"auth-port=NUMBER"  default:"7878"`
 
+	LocalEncoding string `cli:"local-encoding=ENCODING"  default:"utf-8"  help:"encoding of local files {utf-8,utf-8-bom,shift_jis,euc-jp,auto}"`
+	EOL           string `cli:"eol=POLICY"  default:"preserve"  help:"line endings of files to be got and notes to be put {preserve,crlf,lf}"`
+
+	KeepHistory bool `cli:"keep-history"  help:"keep replaced notes as old versions under LABEL/history, instead of trashing them"`
+
 	Auth  authCmd  `help:"update token"`
 	List  listCmd  `cli:"list,ls" help:"list notes(mail messages)" usage:"args accepts Gmail advanced search syntax (https://support.google.com/mail/answer/7190)"`
 	Get   getCmd   `help:"display or download as a file"`
 	Put   putCmd   `help:"upload files as notes(gmail messages)"`
+	Diff  diffCmd  `help:"show differences between files and their notes"`
 	Trash trashCmd `cli:"trash,rm" help:"send messages to the trash"`
+	Sync  syncCmd  `help:"synchronize a directory and notes in both directions"`
+	Watch watchCmd `help:"keep synchronizing a directory, on changes of files and at intervals"`
+	Serve serveCmd `help:"keep synchronizing a directory at intervals, with a local control API"`
+
+	History historyCmd `help:"list old versions of a note kept by --keep-history"`
+	Restore restoreCmd `help:"bring back an old version of a note"`
 }
 
 // var scopes = []string{gmail.MailGoogleComScope}
@@ -132,58 +157,219 @@ func getClient(config *oauth2.Config, tokFile string, port uint16) (*http.Client
 			fmt.Fprintln(os.Stderr, err)
 		}
 	}
-	return config.Client(context.Background(), tok), tok, nil
+	ctx := context.Background()
+	return oauth2.NewClient(ctx, newSavingTokenSource(ctx, config, tok, tokFile)), tok, nil
 }
 
+// openBrowser opens an URL in the browser.
+// Tests replace it.
+var openBrowser = browser.OpenURL
+
+// authTimeout is how long getTokenFromWeb waits for the redirection.
+var authTimeout = 5 * time.Minute
+
 // Request a token from the web, then returns the retrieved token.
+// If port is 0, the redirection is pasted to the terminal instead of received on the port.
+//
+// The authorization is protected by a random state against forged callbacks, and by PKCE.
 func getTokenFromWeb(config *oauth2.Config, port uint16) (*oauth2.Token, error) {
+	if port == 0 {
+		return getTokenFromTerminal(config, os.Stdin, os.Stderr)
+	}
+
 	// setup parameters
 
-	var codeChan chan string
-	config.RedirectURL = fmt.Sprintf("http://localhost:%d/", port)
-	codeChan = make(chan string)
-	go launchRedirectionServer(port, codeChan)
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	config.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/", port)
+	resultChan := make(chan authResult, 1)
+	shutdown, err := launchRedirectionServer(port, state, resultChan)
+	if err != nil {
+		return nil, err
+	}
+	defer shutdown()
 
 	// request authorization (and authentication)
 
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	err := browser.OpenURL(authURL)
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	err = openBrowser(authURL)
 	if err != nil {
 		return nil, err
 	}
 
-	var authCode string
-	authCode = <-codeChan
+	var result authResult
+	select {
+	case result = <-resultChan:
+	case <-time.After(authTimeout):
+		return nil, xerrors.Errorf("no authorization in %v", authTimeout)
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+	tok, err := config.Exchange(context.TODO(), result.code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, xerrors.Errorf("failed to retrieve token from web: %v", err)
 	}
 	return tok, nil
 }
 
-func launchRedirectionServer(port uint16, codeChan chan string) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		code := r.FormValue("code")
-		codeChan <- code
-
-		var color string
-		var icon string
-		var result string
-		if code != "" {
-			//success
-			color = "green"
-			icon = "&#10003;"
-			result = "Successfully authenticated!!"
-		} else {
-			//fail
-			color = "red"
-			icon = "&#10008;"
-			result = "FAILED!"
-		}
-		disp := fmt.Sprintf(`<div><span style="font-size:xx-large; color:%s; border:solid thin %s;">%s</span> %s</div>`, color, color, icon, result)
-
-		fmt.Fprintf(w, `
+// getTokenFromTerminal requests a token without a browser on this machine.
+// The URL to authorize is printed to out, and the URL redirected to (or the code in it) is read from in.
+func getTokenFromTerminal(config *oauth2.Config, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// nothing listens there, but the browser shows the URL with the code
+	config.RedirectURL = "http://localhost/"
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+
+	fmt.Fprintf(out, "Open this URL in a browser on any machine, and authorize:\n\n%v\n\n", authURL)
+	fmt.Fprintf(out, "The browser will be redirected to a page that cannot be opened.\nPaste the URL of that page (or the code in it): ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, xerrors.Errorf("failed to read the code: %v", err)
+	}
+	code, err := parsePastedCode(strings.TrimSpace(line), state)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := config.Exchange(context.TODO(), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to retrieve token from web: %v", err)
+	}
+	return tok, nil
+}
+
+// parsePastedCode returns the authorization code in pasted, a redirected URL or a code.
+// The state in the URL must be state.
+func parsePastedCode(pasted, state string) (string, error) {
+	if u, err := url.Parse(pasted); err == nil && u.RawQuery != "" {
+		q := u.Query()
+		if q.Get("error") != "" {
+			return "", xerrors.Errorf("authorization failed: %v %v", q.Get("error"), q.Get("error_description"))
+		}
+		if q.Has("code") {
+			if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+				return "", xerrors.New("the URL is not of this authorization (state mismatch)")
+			}
+			return q.Get("code"), nil
+		}
+	}
+
+	if pasted == "" {
+		return "", xerrors.New("no code")
+	}
+	return pasted, nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", xerrors.Errorf("failed to generate a state: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// authResult is an authorization code, or an error, passed to the redirect URL.
+type authResult struct {
+	code string
+	err  error
+}
+
+// launchRedirectionServer receives the redirection of the authorization on port of the loopback address.
+// The result is sent to resultChan once, after the response of the redirection.
+// shutdown stops the server, waiting for responses for a while.
+func launchRedirectionServer(port uint16, state string, resultChan chan<- authResult) (shutdown func(), err error) {
+	// not to be reached from other machines
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to listen for the redirection: %v", err)
+	}
+
+	server := &http.Server{
+		Handler:           redirectionHandler(state, resultChan),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(l)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			// connections opened by the browser but not used are waited for until the timeout
+			server.Close()
+		}
+	}, nil
+}
+
+func redirectionHandler(state string, resultChan chan<- authResult) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		// not from the authorization of this run, like another local page
+		if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+
+		var result authResult
+		switch {
+		case q.Get("error") != "":
+			result.err = xerrors.Errorf("authorization failed: %v %v", q.Get("error"), q.Get("error_description"))
+		case q.Get("code") == "":
+			result.err = xerrors.New("authorization failed: no code")
+		default:
+			result.code = q.Get("code")
+		}
+
+		// sent before the result, not to be cut by the shutdown
+		var page bytes.Buffer
+		writeAuthResultPage(&page, result.err == nil)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(page.Len()))
+		w.Write(page.Bytes())
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		// only the first one counts
+		select {
+		case resultChan <- result:
+		default:
+		}
+	})
+	return mux
+}
+
+func writeAuthResultPage(w io.Writer, ok bool) {
+	var color string
+	var icon string
+	var result string
+	if ok {
+		//success
+		color = "green"
+		icon = "&#10003;"
+		result = "Successfully authenticated!!"
+	} else {
+		//fail
+		color = "red"
+		icon = "&#10008;"
+		result = "FAILED!"
+	}
+	disp := fmt.Sprintf(`<div><span style="font-size:xx-large; color:%s; border:solid thin %s;">%s</span> %s</div>`, color, color, icon, result)
+
+	fmt.Fprintf(w, `
 <html>
 	<head><title>%s pomi</title></head>
 	<body onload="open(location, '_self').close();"> <!-- Chrome won't let me close! -->
@@ -193,8 +379,6 @@ func launchRedirectionServer(port uint16, codeChan chan string) {
 	</body>
 </html>
 `, icon, disp)
-	})
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 }
 
 // Retrieves a token from a local file.
@@ -210,22 +394,77 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 }
 
 // Saves a token to a file path.
+// The file is replaced atomically, not to be left broken.
 func saveToken(path string, token *oauth2.Token) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	b, err := json.Marshal(token)
 	if err != nil {
 		return xerrors.Errorf("failed to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(token)
+
+	// in the same directory to be renamed
+	f, err := os.CreateTemp(filepath.Dir(path), ".token-*.tmp")
+	if err != nil {
+		return xerrors.Errorf("failed to cache oauth token: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(append(b, '\n'))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to cache oauth token: %v", err)
+	}
+	return nil
 }
 
-func getHeader(headers []*gmail.MessagePartHeader, key string) string {
-	for _, h := range headers {
-		if h.Name == key {
-			return h.Value
+// savingTokenSource saves tokens of src to path whenever they are changed, like refreshed.
+type savingTokenSource struct {
+	src  oauth2.TokenSource
+	path string
+
+	mut  sync.Mutex
+	last *oauth2.Token
+}
+
+// newSavingTokenSource returns a TokenSource of config saving to path, starting with tok read from path.
+func newSavingTokenSource(ctx context.Context, config *oauth2.Config, tok *oauth2.Token, path string) oauth2.TokenSource {
+	return &savingTokenSource{
+		src:  config.TokenSource(ctx, tok),
+		path: path,
+		last: tok,
+	}
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.last == nil ||
+		tok.AccessToken != s.last.AccessToken ||
+		tok.RefreshToken != s.last.RefreshToken ||
+		!tok.Expiry.Equal(s.last.Expiry) {
+		// the token works anyway in this run
+		if err := saveToken(s.path, tok); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
 		}
+		s.last = tok
 	}
-	return ""
+	return tok, nil
 }
 
 func main() {
@@ -236,8 +475,10 @@ func main() {
 	app.Usage = `* create credentials at https://console.developers.google.com/apis/credentials
 * download credentials.json
 * pmsync auth
+  (pmsync auth --port 0 on a machine without a browser)
 * pmsync get
-* pmsync get -o file`
+* pmsync get -o file
+* pmsync sync`
 	app.Copyright = "(C) 2021 Shuhei Kubota"
 	app.Run(os.Args)
 
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const testLabel = "Notes/pomera_sync"
+
+// useFakeGmail makes commands use f, and returns global options for them.
+func useFakeGmail(t *testing.T, f *fakeGmail) globalCmd {
+	t.Helper()
+
+	orig := newGmailAPI
+	newGmailAPI = func(g globalCmd) (gmailAPI, error) {
+		return f, nil
+	}
+	t.Cleanup(func() {
+		newGmailAPI = orig
+	})
+
+	return globalCmd{
+		UserID: "me",
+		Label:  testLabel,
+		Cache:  "",
+	}
+}
+
+// captureStdout returns what fn writes to os.Stdout.
+func captureStdout(t *testing.T, fn func() error) string {
+	t.Helper()
+	return captureOutput(t, &os.Stdout, fn)
+}
+
+// captureStderr returns what fn writes to os.Stderr.
+func captureStderr(t *testing.T, fn func() error) string {
+	t.Helper()
+	return captureOutput(t, &os.Stderr, fn)
+}
+
+func captureOutput(t *testing.T, file **os.File, fn func() error) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := *file
+	*file = w
+	defer func() {
+		*file = orig
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.Bytes()
+	}()
+
+	fnErr := fn()
+	w.Close()
+	out := <-done
+
+	if fnErr != nil {
+		t.Fatal(fnErr)
+	}
+	return string(out)
+}
+
+// freePort returns a port which is not used now.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// newTokenServer returns a token endpoint accepting code with the PKCE verifier of the challenge.
+func newTokenServer(t *testing.T, code string, challenge *string) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != code || base64.RawURLEncoding.EncodeToString(sum[:]) != *challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGetTokenFromWeb(t *testing.T) {
+	tests := []struct {
+		name   string
+		params func(state string) url.Values
+
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			params: func(state string) url.Values {
+				return url.Values{"state": {state}, "code": {"the-code"}}
+			},
+		},
+		{
+			name: "denied",
+			params: func(state string) url.Values {
+				return url.Values{"state": {state}, "error": {"access_denied"}}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var challenge string
+			ts := newTokenServer(t, "the-code", &challenge)
+			config := &oauth2.Config{
+				ClientID: "id",
+				Endpoint: oauth2.Endpoint{AuthURL: ts.URL + "/auth", TokenURL: ts.URL + "/token"},
+			}
+
+			orig := openBrowser
+			t.Cleanup(func() {
+				openBrowser = orig
+			})
+			openBrowser = func(authURL string) error {
+				u, err := url.Parse(authURL)
+				if err != nil {
+					return err
+				}
+				q := u.Query()
+				if q.Get("code_challenge_method") != "S256" {
+					t.Errorf("no PKCE: %v", authURL)
+				}
+				challenge = q.Get("code_challenge")
+
+				redirect, err := url.Parse(q.Get("redirect_uri"))
+				if err != nil {
+					return err
+				}
+				if redirect.Hostname() != "127.0.0.1" {
+					t.Errorf("not loopback: %v", redirect)
+				}
+
+				// a forged one is ignored
+				resp, err := http.Get(q.Get("redirect_uri") + "?" + url.Values{"state": {"state-token"}, "code": {"forged"}}.Encode())
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("forged: %v", resp.Status)
+				}
+
+				resp, err = http.Get(q.Get("redirect_uri") + "?" + tt.params(q.Get("state")).Encode())
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if page, err := io.ReadAll(resp.Body); err != nil || !strings.Contains(string(page), "</html>") {
+					t.Errorf("page: %q, %v", page, err)
+				}
+				return nil
+			}
+
+			tok, err := getTokenFromWeb(config, freePort(t))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("error expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+				t.Errorf("got %+v", tok)
+			}
+		})
+	}
+}
+
+func TestGetTokenFromWebTimeout(t *testing.T) {
+	origTimeout, origBrowser := authTimeout, openBrowser
+	t.Cleanup(func() {
+		authTimeout, openBrowser = origTimeout, origBrowser
+	})
+	authTimeout = 100 * time.Millisecond
+
+	// abandoned, with a connection opened but not used
+	openBrowser = func(authURL string) error {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		redirect, err := url.Parse(u.Query().Get("redirect_uri"))
+		if err != nil {
+			return err
+		}
+		conn, err := net.Dial("tcp", redirect.Host)
+		if err != nil {
+			return err
+		}
+		t.Cleanup(func() { conn.Close() })
+		return nil
+	}
+
+	port := freePort(t)
+	config := &oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{AuthURL: "http://127.0.0.1/auth"}}
+	start := time.Now()
+	if _, err := getTokenFromWeb(config, port); err == nil {
+		t.Error("error expected")
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("stalled for %v", d)
+	}
+
+	// released
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestParsePastedCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		pasted string
+
+		want    string
+		wantErr bool
+	}{
+		{name: "url", pasted: "http://localhost/?state=st&code=4/abc&scope=x", want: "4/abc"},
+		{name: "code", pasted: "4/abc", want: "4/abc"},
+		{name: "other state", pasted: "http://localhost/?state=other&code=4/abc", wantErr: true},
+		{name: "no state", pasted: "http://localhost/?code=4/abc", wantErr: true},
+		{name: "error", pasted: "http://localhost/?state=st&error=access_denied", wantErr: true},
+		{name: "empty", pasted: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePastedCode(tt.pasted, "st")
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("err: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// pasteReader pastes what fn returns for the URL printed to out.
+type pasteReader struct {
+	out *bytes.Buffer
+	fn  func(authURL string) string
+	r   io.Reader
+}
+
+func (p *pasteReader) Read(b []byte) (int, error) {
+	if p.r == nil {
+		authURL := ""
+		for _, line := range strings.Split(p.out.String(), "\n") {
+			if strings.HasPrefix(line, "http") {
+				authURL = line
+			}
+		}
+		p.r = strings.NewReader(p.fn(authURL) + "\n")
+	}
+	return p.r.Read(b)
+}
+
+func TestGetTokenFromTerminal(t *testing.T) {
+	var challenge string
+	ts := newTokenServer(t, "the-code", &challenge)
+	config := &oauth2.Config{
+		ClientID: "id",
+		Endpoint: oauth2.Endpoint{AuthURL: ts.URL + "/auth", TokenURL: ts.URL + "/token"},
+	}
+
+	var out bytes.Buffer
+	in := &pasteReader{
+		out: &out,
+		fn: func(authURL string) string {
+			u, err := url.Parse(authURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := u.Query()
+			challenge = q.Get("code_challenge")
+			return q.Get("redirect_uri") + "?" + url.Values{"state": {q.Get("state")}, "code": {"the-code"}}.Encode()
+		},
+	}
+
+	tok, err := getTokenFromTerminal(config, in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.RefreshToken != "refresh" {
+		t.Errorf("got %+v", tok)
+	}
+}
+
+func TestSaveToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token.json")
+	os.WriteFile(path, []byte("old"), 0644)
+
+	if err := saveToken(path, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := tokenFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+		t.Errorf("got %+v", tok)
+	}
+	if fi, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Errorf("stat: %v, %v", fi.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files are left: %v", entries)
+	}
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	refreshes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		// a rotated refresh token
+		fmt.Fprintf(w, `{"access_token":"access%d","refresh_token":"refresh%d","token_type":"Bearer","expires_in":3600}`, refreshes, refreshes)
+	}))
+	defer ts.Close()
+
+	config := &oauth2.Config{
+		ClientID: "id",
+		Endpoint: oauth2.Endpoint{TokenURL: ts.URL},
+	}
+	path := filepath.Join(t.TempDir(), "token.json")
+	expired := &oauth2.Token{AccessToken: "access0", RefreshToken: "refresh0", Expiry: time.Now().Add(-time.Hour)}
+	saveToken(path, expired)
+
+	src := newSavingTokenSource(context.Background(), config, expired, path)
+	for i := 0; i < 3; i++ {
+		tok, err := src.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "access1" {
+			t.Errorf("got %+v", tok)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times", refreshes)
+	}
+
+	saved, err := tokenFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "access1" || saved.RefreshToken != "refresh1" {
+		t.Errorf("saved %+v", saved)
+	}
+
+	// not saved if not changed
+	os.Remove(path)
+	if _, err := src.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("saved again")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// syncRunner runs syncs one at a time, at intervals or on demand,
+// and keeps their results for the control API.
+type syncRunner struct {
+	dir      string
+	interval time.Duration
+	sync     func() (*syncReport, error)
+
+	triggered chan struct{}
+
+	mut       sync.Mutex
+	running   bool
+	syncs     int
+	lastRun   time.Time
+	lastErr   error
+	last      *syncReport // of the last sync that has run to the end
+	next      time.Time
+	conflicts []syncConflictReport
+}
+
+func newSyncRunner(dir string, interval time.Duration, fn func() (*syncReport, error)) *syncRunner {
+	return &syncRunner{
+		dir:       dir,
+		interval:  interval,
+		sync:      fn,
+		triggered: make(chan struct{}, 1),
+	}
+}
+
+// run runs syncs until ctx is done, starting with one right away.
+// A sync in progress is completed before returning.
+func (r *syncRunner) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-r.triggered:
+		}
+
+		r.runOnce()
+
+		r.mut.Lock()
+		r.next = time.Now().Add(r.interval)
+		r.mut.Unlock()
+		timer.Reset(r.interval)
+	}
+}
+
+// trigger requests a sync.
+// Requests while another is waiting are merged into it.
+func (r *syncRunner) trigger() {
+	select {
+	case r.triggered <- struct{}{}:
+	default:
+	}
+}
+
+func (r *syncRunner) runOnce() {
+	r.mut.Lock()
+	r.running = true
+	r.mut.Unlock()
+
+	fmt.Fprintf(os.Stderr, "syncing: %v (%v)\n", r.dir, time.Now().Format(time.RFC3339))
+	rep, err := r.sync()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.running = false
+	r.syncs++
+	r.lastRun = time.Now()
+	r.lastErr = err
+	if rep == nil {
+		return
+	}
+	r.last = rep
+
+	// conflicts reported again replace the old ones
+	conflicts := make([]syncConflictReport, 0, len(r.conflicts)+len(rep.Conflicts))
+	for _, old := range r.conflicts {
+		again := false
+		for _, c := range rep.Conflicts {
+			again = again || c.Path == old.Path
+		}
+		if !again && old.pending(r.dir) {
+			conflicts = append(conflicts, old)
+		}
+	}
+	r.conflicts = append(conflicts, rep.Conflicts...)
+}
+
+// runnerStatus is the status of a syncRunner.
+type runnerStatus struct {
+	Running          bool        `json:"running"`
+	Syncs            int         `json:"syncs"`
+	LastRun          *time.Time  `json:"last_run,omitempty"`
+	LastError        string      `json:"last_error,omitempty"`
+	LastReport       *syncReport `json:"last_report,omitempty"`
+	Next             *time.Time  `json:"next,omitempty"`
+	PendingConflicts int         `json:"pending_conflicts"`
+}
+
+func (r *syncRunner) status() runnerStatus {
+	conflicts := r.pendingConflicts()
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	st := runnerStatus{
+		Running:          r.running,
+		Syncs:            r.syncs,
+		LastReport:       r.last,
+		PendingConflicts: len(conflicts),
+	}
+	if !r.lastRun.IsZero() {
+		t := r.lastRun
+		st.LastRun = &t
+	}
+	if r.lastErr != nil {
+		st.LastError = r.lastErr.Error()
+	}
+	if !r.next.IsZero() {
+		t := r.next
+		st.Next = &t
+	}
+	return st
+}
+
+// pendingConflicts returns conflicts not resolved yet by the user, older first.
+func (r *syncRunner) pendingConflicts() []syncConflictReport {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	conflicts := make([]syncConflictReport, 0, len(r.conflicts))
+	for _, c := range r.conflicts {
+		if c.Kind == conflictReportSkipped || c.pending(r.dir) {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// handler returns the control API of r.
+//
+//	POST /sync       requests a sync
+//	GET  /status     status, with the last error
+//	GET  /conflicts  pending conflicts
+func (r *syncRunner) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		r.trigger()
+		writeJSON(w, http.StatusAccepted, map[string]bool{"requested": true})
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.status())
+	})
+
+	mux.HandleFunc("/conflicts", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.pendingConflicts())
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncRunnerAPI(t *testing.T) {
+	dir := t.TempDir()
+	aside := "memo (conflict).txt"
+	os.WriteFile(filepath.Join(dir, aside), []byte("remote"), 0644)
+
+	results := make(chan error, 10)
+	results <- nil
+	results <- errors.New("offline")
+	r := newSyncRunner(dir, time.Hour, func() (*syncReport, error) {
+		if err := <-results; err != nil {
+			return nil, err
+		}
+		return &syncReport{
+			Actions: 1,
+			Conflicts: []syncConflictReport{
+				{Path: "memo.txt", Subject: "memo", Kind: conflictReportAside, Aside: aside},
+			},
+		}, nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + l.Addr().String()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- serveRunner(ctx, r, l)
+	}()
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := client.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSyncs := func(n int) runnerStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var st runnerStatus
+			get("/status", &st)
+			if st.Syncs >= n && !st.Running {
+				return st
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("syncs: got %v, want %v", st.Syncs, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the first sync at start
+	st := waitSyncs(1)
+	if st.LastError != "" || st.LastReport == nil || st.PendingConflicts != 1 {
+		t.Errorf("status: %+v", st)
+	}
+
+	// requested
+	resp, err := client.Post(base+"/sync", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("POST /sync: %v", resp.Status)
+	}
+	st = waitSyncs(2)
+	if st.LastError != "offline" || st.LastReport == nil {
+		t.Errorf("status: %+v", st)
+	}
+
+	resp, err = client.Get(base + "/sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /sync: %v", resp.Status)
+	}
+
+	var conflicts []syncConflictReport
+	get("/conflicts", &conflicts)
+	if len(conflicts) != 1 || conflicts[0].Path != "memo.txt" {
+		t.Errorf("conflicts: %+v", conflicts)
+	}
+
+	// resolved by removing the aside
+	os.Remove(filepath.Join(dir, aside))
+	get("/conflicts", &conflicts)
+	if len(conflicts) != 0 {
+		t.Errorf("conflicts: %+v", conflicts)
+	}
+
+	client.CloseIdleConnections()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped")
+	}
+}
+
+func TestSyncReportsConflicts(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	g := useFakeGmail(t, f)
+	sc := syncCmd{Dir: dir, Conflict: conflictMerge, LocalDelete: localDeleteTrash, MaxDelete: 50, PlanFormat: "text"}
+
+	name := filepath.Join(dir, "memo.txt")
+	os.WriteFile(name, []byte("a\nb\nc\n"), 0644)
+	if _, err := sc.sync(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same line is changed on both sides
+	os.WriteFile(name, []byte("a\nlocal\nc\n"), 0644)
+	for id := range f.messages {
+		delete(f.messages, id)
+	}
+	f.addNote(testLabel, "memo", "a\nremote\nc\n", time.Now())
+
+	rep, err := sc.sync(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Conflicts) != 1 || rep.Conflicts[0].Kind != conflictReportMarkers || !rep.Conflicts[0].pending(dir) {
+		t.Fatalf("conflicts: %+v", rep.Conflicts)
+	}
+
+	// the remote one is kept until resolved
+	if got := f.notes(testLabel); got["memo"] != "a\nremote\nc\n" {
+		t.Errorf("remote: got %q", got["memo"])
+	}
+	rep, err = sc.sync(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Conflicts) != 1 || rep.Conflicts[0].Kind != conflictReportMarkers {
+		t.Errorf("conflicts again: %+v", rep.Conflicts)
+	}
+	if got := f.notes(testLabel); got["memo"] != "a\nremote\nc\n" {
+		t.Errorf("remote: got %q", got["memo"])
+	}
+
+	// resolved by the user
+	os.WriteFile(name, []byte("a\nresolved\nc\n"), 0644)
+	if rep.Conflicts[0].pending(dir) {
+		t.Error("still pending")
+	}
+	rep, err = sc.sync(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Conflicts) != 0 {
+		t.Errorf("conflicts: %+v", rep.Conflicts)
+	}
+	if got := f.notes(testLabel); got["memo"] != "a\nresolved\nc\n" {
+		t.Errorf("remote: got %q", got["memo"])
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7879}
+	unix := &net.UnixAddr{Name: "/tmp/pmsync.sock", Net: "unix"}
+
+	tests := []struct {
+		name   string
+		addr   net.Addr
+		host   string
+		origin string
+
+		want int
+	}{
+		{name: "ip", addr: tcp, host: "127.0.0.1:7879", want: http.StatusOK},
+		{name: "localhost", addr: tcp, host: "localhost:7879", want: http.StatusOK},
+		{name: "ipv6", addr: tcp, host: "[::1]:7879", want: http.StatusOK},
+		{name: "same origin", addr: tcp, host: "127.0.0.1:7879", origin: "http://127.0.0.1:7879", want: http.StatusOK},
+		{name: "rebound name", addr: tcp, host: "evil.example.com:7879", want: http.StatusForbidden},
+		{name: "other port", addr: tcp, host: "127.0.0.1:80", want: http.StatusForbidden},
+		{name: "no port", addr: tcp, host: "127.0.0.1", want: http.StatusForbidden},
+		{name: "cross origin", addr: tcp, host: "127.0.0.1:7879", origin: "http://evil.example.com", want: http.StatusForbidden},
+		{name: "unix", addr: unix, host: "localhost", want: http.StatusOK},
+		{name: "unix cross origin", addr: unix, host: "localhost", origin: "http://evil.example.com", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/sync", nil)
+			req.Host = tt.host
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			localOnly(tt.addr, h).ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
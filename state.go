@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// stateFileName is the default name of the sync state file in the synchronized directory.
+const stateFileName = ".pmsync.json"
+
+// syncState is the result of the last sync.
+// It is used to tell which side (local or remote) has changed since then.
+type syncState struct {
+	Notes []*noteState `json:"notes"`
+
+	path string
+}
+
+// noteState is a note as of the last sync.
+type noteState struct {
+	ID         string    `json:"id"`             // Gmail message ID
+	UUID       string    `json:"uuid,omitempty"` // X-Universally-Unique-Identifier
+	Path       string    `json:"path"`           // relative to the synchronized directory
+	Subject    string    `json:"subject"`
+	LocalHash  string    `json:"local_hash"`
+	RemoteHash string    `json:"remote_hash"`
+	SyncedAt   time.Time `json:"synced_at"`
+
+	// Base is the content as of the last sync, the common ancestor for merging.
+	Base string `json:"base,omitempty"`
+}
+
+// localChanged reports whether local is changed since the last sync.
+func (n *noteState) localChanged(local []byte) bool {
+	return hashContent(local) != n.LocalHash
+}
+
+// remoteChanged reports whether remote is changed, or replaced by another message, since the last sync.
+func (n *noteState) remoteChanged(remote *note) bool {
+	return remote.ID != n.ID || hashContent(remote.Body) != n.RemoteHash
+}
+
+// changedOnBothSides reports whether local and remote are changed since the last sync.
+func (n *noteState) changedOnBothSides(local []byte, remote *note) bool {
+	return n.localChanged(local) && n.remoteChanged(remote)
+}
+
+// loadSyncState reads a state file.
+// A missing file results in an empty state.
+func loadSyncState(path string) (*syncState, error) {
+	s := &syncState{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, xerrors.Errorf("reading state file: %v", err)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, xerrors.Errorf("state file %v: %v", path, err)
+	}
+
+	return s, nil
+}
+
+func (s *syncState) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return xerrors.Errorf("mkdir %v: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(s.path, b, 0600); err != nil {
+		return xerrors.Errorf("writing state file: %v", err)
+	}
+	return nil
+}
+
+func (s *syncState) byPath(path string) *noteState {
+	for _, n := range s.Notes {
+		if n.Path == path {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *syncState) byID(id string) *noteState {
+	for _, n := range s.Notes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *syncState) byUUID(uuid string) *noteState {
+	if uuid == "" {
+		return nil
+	}
+	for _, n := range s.Notes {
+		if n.UUID == uuid {
+			return n
+		}
+	}
+	return nil
+}
+
+// update records n, replacing the entry with the same path.
+func (s *syncState) update(n *noteState) {
+	n.SyncedAt = time.Now()
+	for i, nn := range s.Notes {
+		if nn == n || nn.Path == n.Path {
+			s.Notes[i] = n
+			return
+		}
+	}
+	s.Notes = append(s.Notes, n)
+}
+
+func (s *syncState) remove(n *noteState) {
+	for i, nn := range s.Notes {
+		if nn == n {
+			s.Notes = append(s.Notes[:i], s.Notes[i+1:]...)
+			return
+		}
+	}
+}
+
+// hashContent returns a hash of content, ignoring differences of line endings.
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(convertEOL(content, eolLF))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/mail"
+	"time"
+)
+
+// NoteStore is a storage of notes under a label.
+// Commands operate notes through it, not knowing the backend.
+type NoteStore interface {
+	// Labels returns names of all labels.
+	Labels() ([]string, error)
+
+	// List returns notes matching q (Gmail advanced search syntax), newer first.
+	// If max > 0, only max notes are returned.
+	// The total number of the matching notes is also returned.
+	List(q string, max int) ([]*note, int, error)
+
+	// Get returns a note.
+	Get(id string) (*note, error)
+
+	// Create creates a note.
+	// uuid identifies the note across updates, and a new one is given if empty.
+	Create(uuid, subject string, body []byte) (*note, error)
+
+	// Update replaces the note id with a new one.
+	// Note that the ID is changed, while the UUID is kept.
+	// The old one is trashed, or archived if history is kept.
+	Update(id, subject string, body []byte) (*note, error)
+
+	// Trash sends a note to the trash.
+	Trash(id string) error
+
+	// Restore brings back a note from the trash.
+	Restore(id string) error
+
+	// Archive moves a note to the history as an old version.
+	Archive(id string) error
+
+	// Versions returns old versions of a note in the history, newer first.
+	// The note is identified by uuid, or by subject if uuid is empty.
+	Versions(uuid, subject string) ([]*note, error)
+
+	// Unreadable returns IDs of messages skipped by List and Versions, failed to be read.
+	Unreadable() []string
+
+	// Close saves what is to be kept across runs.
+	Close() error
+}
+
+// note is a memo, a message under a label.
+type note struct {
+	ID      string
+	UUID    string // X-Universally-Unique-Identifier, same across updates
+	Subject string
+	Date    time.Time
+	Snippet string
+	Body    []byte
+
+	// HTML is the original of Body if the note has only HTML.
+	HTML []byte
+
+	Header mail.Header
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncer transfers notes between a directory and a label, recording the results in a sync state.
+type syncer struct {
+	store NoteStore
+
+	dir   string
+	codec localCodec
+	state *syncState
+
+	// remote notes, listed on demand
+	byUUID map[string]*note
+	byID   map[string]*note
+}
+
+// upload creates a note of content, replacing the note replaceID if given.
+// path is relative to s.dir, or empty if the file is not under s.dir.
+func (s *syncer) upload(path, subject string, content []byte, replaceID string) (*noteState, error) {
+	var n *note
+	var err error
+	if replaceID != "" {
+		n, err = s.store.Update(replaceID, subject, content)
+	} else {
+		// a note deleted remotely comes back as the same note
+		uuid := ""
+		if path != "" {
+			if ns := s.state.byPath(path); ns != nil {
+				uuid = ns.UUID
+			}
+		}
+		n, err = s.store.Create(uuid, subject, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ns := &noteState{
+		ID:         n.ID,
+		UUID:       n.UUID,
+		Path:       path,
+		Subject:    subject,
+		LocalHash:  hashContent(content),
+		RemoteHash: hashContent(content),
+		Base:       string(content),
+	}
+	if path != "" {
+		s.state.update(ns)
+	}
+	return ns, nil
+}
+
+// download writes the content of remote to path.
+func (s *syncer) download(path string, remote *note) (*noteState, error) {
+	name := filepath.Join(s.dir, path)
+	if err := s.codec.writeFile(name, remote.Body); err != nil {
+		return nil, err
+	}
+
+	ns := &noteState{
+		ID:         remote.ID,
+		UUID:       remote.UUID,
+		Path:       path,
+		Subject:    remote.Subject,
+		LocalHash:  hashContent(remote.Body),
+		RemoteHash: hashContent(remote.Body),
+		Base:       string(remote.Body),
+	}
+	s.state.update(ns)
+	return ns, nil
+}
+
+// writeAside writes the content of remote to a sibling of path, and returns the sibling.
+func (s *syncer) writeAside(path string, remote *note) (string, error) {
+	name := conflictPath(filepath.Join(s.dir, path), time.Now())
+	if err := s.codec.writeFile(name, remote.Body); err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(s.dir, name)
+	if err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// listRemotes lists the remote notes under the label once, for remoteByUUID and remoteByID.
+// Trashed notes and ones moved out of the label are not listed.
+func (s *syncer) listRemotes() error {
+	if s.byUUID != nil {
+		return nil
+	}
+
+	notes, _, err := s.store.List("", 0)
+	if err != nil {
+		return err
+	}
+	s.byUUID = make(map[string]*note, len(notes))
+	s.byID = make(map[string]*note, len(notes))
+	for _, n := range notes {
+		s.byID[n.ID] = n
+		// newer first
+		if _, found := s.byUUID[n.UUID]; n.UUID != "" && !found {
+			s.byUUID[n.UUID] = n
+		}
+	}
+	return nil
+}
+
+// remoteByUUID returns the latest remote note of uuid, or nil if not found.
+func (s *syncer) remoteByUUID(uuid string) (*note, error) {
+	if err := s.listRemotes(); err != nil {
+		return nil, err
+	}
+	return s.byUUID[uuid], nil
+}
+
+// remoteByID returns the remote note id if it is still under the label, or nil.
+func (s *syncer) remoteByID(id string) (*note, error) {
+	if err := s.listRemotes(); err != nil {
+		return nil, err
+	}
+	return s.byID[id], nil
+}
+
+// remotesBySubject returns remote notes whose subject is exactly subject, newer first.
+func (s *syncer) remotesBySubject(subject string) ([]*note, error) {
+	candidates, _, err := s.store.List(subjectQuery(subject), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []*note
+	for _, n := range candidates {
+		if n.Subject == subject {
+			notes = append(notes, n)
+		}
+	}
+	return notes, nil
+}
+
+// findRemote returns the remote note of a local file, and other remote notes duplicating it.
+// ns is the state of the file if any.
+// If notes of subject are different ones, an *ambiguousError is returned.
+func (s *syncer) findRemote(ns *noteState, subject string) (remote *note, duplicates []*note, err error) {
+	if ns != nil && ns.UUID != "" {
+		// the same note even if renamed
+		remote, err = s.remoteByUUID(ns.UUID)
+		if err != nil || remote != nil {
+			return remote, nil, err
+		}
+	}
+	if ns != nil {
+		// not the message itself, which may be trashed or out of the label
+		remote, err = s.remoteByID(ns.ID)
+		if err != nil || remote != nil {
+			return remote, nil, err
+		}
+	}
+
+	matches, err := s.remotesBySubject(subject)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// not other notes known by their UUIDs
+	candidates := matches[:0]
+	for _, n := range matches {
+		if n.UUID != "" && (ns == nil || n.UUID != ns.UUID) && s.state.byUUID(n.UUID) != nil {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+
+	if isAmbiguous(candidates) {
+		return nil, nil, &ambiguousError{notes: candidates}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+	return candidates[0], candidates[1:], nil
+}
+
+// ambiguousError is returned if a subject matches different notes.
+type ambiguousError struct {
+	notes []*note
+}
+
+func (e *ambiguousError) ids() string {
+	ids := make([]string, 0, len(e.notes))
+	for _, n := range e.notes {
+		ids = append(ids, n.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func (e *ambiguousError) Error() string {
+	return fmt.Sprintf("matches %d different notes (%v)", len(e.notes), e.ids())
+}
+
+// isAmbiguous reports whether notes of the same subject are different notes, having different UUIDs.
+// Otherwise they are duplicates of a note.
+func isAmbiguous(notes []*note) bool {
+	uuid := ""
+	for _, n := range notes {
+		if n.UUID == "" {
+			continue
+		}
+		if uuid != "" && n.UUID != uuid {
+			return true
+		}
+		uuid = n.UUID
+	}
+	return false
+}
+
+// relPath returns name relative to s.dir, or empty if name is not under s.dir.
+func (s *syncer) relPath(name string) string {
+	rel, err := filepath.Rel(s.dir, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return rel
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// noteUUIDs returns subject->UUID of the notes under the label.
+func (f *fakeGmail) noteUUIDs(labelName string) map[string]string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	labelID := f.labelID(labelName)
+	uuids := make(map[string]string)
+	for _, m := range f.messages {
+		if !hasLabel(m, labelID) || hasLabel(m, "TRASH") {
+			continue
+		}
+		header, _ := parseFakeMessage(m.raw)
+		uuids[decodeFakeHeader(header.Get("Subject"))] = header.Get(uuidHeader)
+	}
+	return uuids
+}
+
+func TestPutKeepsUUID(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	g := useFakeGmail(t, f)
+	put := func() {
+		captureStdout(t, func() error {
+			return putCmd{InputSrc: dir, Conflict: conflictKeepBoth, PlanFormat: "text"}.Run(g, []string{"memo.txt"})
+		})
+	}
+
+	name := filepath.Join(dir, "memo.txt")
+	os.WriteFile(name, []byte("v1"), 0644)
+	put()
+	first := f.noteUUIDs(testLabel)["memo"]
+	if first == "" {
+		t.Fatal("no UUID")
+	}
+
+	os.WriteFile(name, []byte("v2"), 0644)
+	put()
+	if got := f.noteUUIDs(testLabel)["memo"]; got != first {
+		t.Errorf("UUID changed: %v -> %v", first, got)
+	}
+
+	// deleted remotely, and put again
+	for id := range f.messages {
+		f.TrashMessage("me", id)
+	}
+	put()
+	if got := f.noteUUIDs(testLabel)["memo"]; got != first {
+		t.Errorf("UUID changed: %v -> %v", first, got)
+	}
+}
+
+func TestPutMatchesByUUID(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakeGmail(testLabel)
+	g := useFakeGmail(t, f)
+	put := func() {
+		captureStdout(t, func() error {
+			return putCmd{InputSrc: dir, Conflict: conflictPreferLocal, PlanFormat: "text"}.Run(g, []string{"memo.txt"})
+		})
+	}
+
+	name := filepath.Join(dir, "memo.txt")
+	os.WriteFile(name, []byte("v1"), 0644)
+	put()
+	uuid := f.noteUUIDs(testLabel)["memo"]
+
+	// renamed on a phone, and another note of the same title is created
+	for id := range f.messages {
+		delete(f.messages, id)
+	}
+	f.addRaw(testLabel, "Subject: renamed\r\n"+uuidHeader+": "+uuid+"\r\n\r\nv1", time.Now())
+	f.addNote(testLabel, "memo", "another", time.Now().Add(time.Minute))
+
+	os.WriteFile(name, []byte("v2"), 0644)
+	put()
+
+	got := f.notes(testLabel)
+	if got["memo"] != "another" || got["renamed"] != "v2" || len(got) != 2 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestPlanSyncMatchesByUUID(t *testing.T) {
+	state := &syncState{Notes: []*noteState{{
+		ID:         "old",
+		UUID:       "U1",
+		Path:       "memo.txt",
+		Subject:    "memo",
+		LocalHash:  hashContent([]byte("base")),
+		RemoteHash: hashContent([]byte("base")),
+		Base:       "base",
+	}}}
+	locals := map[string][]byte{"memo.txt": []byte("base")}
+	remotes := map[string]*note{
+		"other":   {ID: "other", UUID: "U2", Subject: "memo", Body: []byte("other note")},
+		"renamed": {ID: "renamed", UUID: "U1", Subject: "renamed", Body: []byte("edited")},
+	}
+
+	actions := planSync(state, locals, remotes)
+	if len(actions) != 2 {
+		t.Fatalf("got %+v", actions)
+	}
+	if a := actions[0]; a.Op != syncDownload || a.remote.ID != "renamed" || a.Path != "memo.txt" || a.Subject != "renamed" {
+		t.Errorf("got %+v", a)
+	}
+	if a := actions[1]; a.Op != syncDownloadAside || a.remote.ID != "other" {
+		t.Errorf("got %+v", a)
+	}
+}